@@ -24,18 +24,30 @@ func Authorize(c *gin.Context) {
 
 	userService := service.UserService{}
 
-	if userModel, err := userService.Authorize(&authModel); err != nil {
-		c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+	if userModel, policy, err := userService.Authorize(c.Request.Context(), &authModel); err != nil {
+		if utility.IsAccountError(err) || utility.IsUnavailable(err) {
+			statusCode, message := errorToHttpStatus(err)
+			c.JSON(statusCode, message)
+		} else {
+			c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
 		return
 	} else if tokenSet, expire_in, err := userService.CreateAuth(&userModel); err != nil {
 		statusCode, message := errorToHttpStatus(err)
 		c.JSON(statusCode, message)
 	} else {
-		c.JSON(http.StatusOK, gin.H{
+		response := gin.H{
 			"access_token":  tokenSet.AccessToken.Token,
 			"refresh_token": tokenSet.RefreshToken.Token,
 			"expire_in":     expire_in.AccessToken,
-			"token_type":    "Bearer"})
+			"token_type":    "Bearer"}
+		if policy.ExpiresIn >= 0 {
+			response["password_expires_in"] = policy.ExpiresIn
+		}
+		if policy.GraceLogins >= 0 {
+			response["grace_logins_remaining"] = policy.GraceLogins
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
 
@@ -55,7 +67,7 @@ func Verify(c *gin.Context) {
 
 	if accessToken, ok := mapToken["access_token"]; !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "access_token is required."})
-	} else if userModel, expire_in, err := userService.VerifyAuth(accessToken); err != nil {
+	} else if userModel, expire_in, err := userService.VerifyAuth(c.Request.Context(), accessToken); err != nil {
 		statusCode, message := errorToHttpStatus(err)
 		c.JSON(statusCode, message)
 	} else {
@@ -79,7 +91,7 @@ func Refresh(c *gin.Context) {
 
 	if refreshToken, ok := mapToken["refresh_token"]; !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh_token is required."})
-	} else if tokenSet, expire_in, err := userService.RefreshAuth(refreshToken); err != nil {
+	} else if tokenSet, expire_in, err := userService.RefreshAuth(c.Request.Context(), refreshToken); err != nil {
 		statusCode, message := errorToHttpStatus(err)
 		c.JSON(statusCode, message)
 	} else {
@@ -115,6 +127,30 @@ func Deauthorize(c *gin.Context) {
 	}
 }
 
+func ChangePassword(c *gin.Context) {
+	if c.Request.Method != "POST" {
+		c.String(http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	passwordChange := model.PasswordChange{}
+	if err := c.ShouldBindJSON(&passwordChange); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	userService := service.UserService{}
+
+	if passwordChange.AccessToken == "" && passwordChange.Username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "access_token or username is required."})
+	} else if err := userService.ChangePassword(c.Request.Context(), &passwordChange); err != nil {
+		statusCode, message := errorToHttpStatus(err)
+		c.JSON(statusCode, message)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"result": true})
+	}
+}
+
 func errorToHttpStatus(error error) (statusCode int, message gin.H) {
 	if error, ok := error.(*utility.Error); ok {
 		errNo := error.No()
@@ -127,10 +163,17 @@ func errorToHttpStatus(error error) (statusCode int, message gin.H) {
 			statusCode = http.StatusUnauthorized
 		case utility.UnexpectedSigningMethod:
 			statusCode = http.StatusUnprocessableEntity
+		case utility.PasswordRejected:
+			statusCode = http.StatusUnprocessableEntity
+		case utility.ServiceUnavailable:
+			statusCode = http.StatusServiceUnavailable
 		case utility.Forbidden:
 			statusCode = http.StatusForbidden
 		case utility.Expired:
 			statusCode = http.StatusUnauthorized
+		case utility.AccountDisabled, utility.AccountLocked, utility.AccountExpired,
+			utility.PasswordExpired, utility.PasswordMustChange, utility.AccessDenied:
+			statusCode = http.StatusForbidden
 		default:
 			statusCode = http.StatusUnauthorized
 		}
@@ -0,0 +1,18 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hasBearerToken checks "Authorization: Bearer <token>" of the request,
+// an empty token never matches.
+func hasBearerToken(c *gin.Context, token string) bool {
+	header := c.GetHeader("Authorization")
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+}
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/michibiki-io/ldap-jwt-go/service"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+)
+
+func Metrics(c *gin.Context) {
+	if c.Request.Method != "GET" {
+		c.String(http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	// METRICS_ENABLED
+	// The metrics expose the LDAP servers, so they are disabled by default
+	if !utility.GetBoolEnv("METRICS_ENABLED", false) {
+		c.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	// METRICS_TOKEN
+	// Bearer token required for the metrics, not required when empty
+	if token := utility.GetEnv("METRICS_TOKEN", ""); token != "" && !hasBearerToken(c, token) {
+		c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+
+	metricsService := service.MetricsService{}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ldap": metricsService.LdapRealms()})
+}
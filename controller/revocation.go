@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/michibiki-io/ldap-jwt-go/service"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+)
+
+// Revocations streams revoked token uuids as Server-Sent Events.
+func Revocations(c *gin.Context) {
+	if c.Request.Method != "GET" {
+		c.String(http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	// REVOCATION_TOKEN
+	// Bearer token required by the subscribers, /v1/revocations is disabled when empty
+	token := utility.GetEnv("REVOCATION_TOKEN", "")
+	if token == "" {
+		c.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	} else if !hasBearerToken(c, token) {
+		c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+
+	revocationService := service.RevocationService{}
+	events, unsubscribe, ok := revocationService.Subscribe()
+	if !ok {
+		c.String(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+		return
+	}
+	defer unsubscribe()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case revocation, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent("revocation", revocation)
+			return true
+		case <-keepAlive.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		}
+	})
+}
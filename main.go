@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/michibiki-io/ldap-jwt-go/controller"
+	"github.com/michibiki-io/ldap-jwt-go/service"
 )
 
 func main() {
@@ -13,6 +14,10 @@ func main() {
 		v1.Any("/verify", controller.Verify)
 		v1.Any("/refresh", controller.Refresh)
 		v1.Any("/deauthorize", controller.Deauthorize)
+		v1.Any("/password", controller.ChangePassword)
+		v1.Any("/revocations", controller.Revocations)
+		v1.Any("/metrics", controller.Metrics)
 	}
+	service.StartSync()
 	engine.Run(":80")
 }
@@ -3,4 +3,5 @@ package model
 type Auth struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Realm    string `json:"realm"`
 }
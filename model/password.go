@@ -0,0 +1,18 @@
+package model
+
+// PasswordChange is authenticated by AccessToken, or by Username and
+// OldPassword when the user cannot log in before changing the password.
+type PasswordChange struct {
+	AccessToken string `json:"access_token"`
+	Username    string `json:"username"`
+	Realm       string `json:"realm"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// PasswordPolicy is returned by the password policy control on login.
+// Each field is -1 when it is unknown.
+type PasswordPolicy struct {
+	ExpiresIn   int64
+	GraceLogins int64
+}
@@ -0,0 +1,17 @@
+package model
+
+// Revocation is published whenever stored tokens are deleted before they expire.
+type Revocation struct {
+	Reason    string   `json:"reason"`
+	Uuids     []string `json:"uuids"`
+	RevokedAt int64    `json:"revoked_at"`
+}
+
+const (
+	RevokeReasonLogout    = "logout"
+	RevokeReasonRotation  = "rotation"
+	RevokeReasonReuse     = "reuse"
+	RevokeReasonPassword  = "password_change"
+	RevokeReasonDirectory = "directory_change"
+	RevokeReasonExpired   = "session_expired"
+)
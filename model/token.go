@@ -3,6 +3,7 @@ package model
 type Token struct {
 	Token   string
 	Uuid    string
+	Realm   string
 	Expires int64
 }
 
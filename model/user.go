@@ -4,6 +4,8 @@ type User struct {
 	DN     string
 	Id     string
 	Groups []string
+	Realm  string            `json:",omitempty"`
+	Claims map[string]string `json:",omitempty"`
 }
 
 type StoreType int8
@@ -13,8 +15,37 @@ const (
 	StoreTypeRefresh
 )
 
+// Session is carried over from the password login to every refreshed token.
+// User is captured at login when the directory cannot be searched without
+// the password of the user.
+type Session struct {
+	FamilyId string
+	AuthTime int64
+	User     *User `json:",omitempty"`
+}
+
 type StoredAuth struct {
 	Type       StoreType
 	UserId     string
+	Realm      string
 	LinkedUuid string
+	IssuedAt   int64
+	Session
+}
+
+// TokenFamily holds the current token pair of a refresh token family.
+// Every refresh rotates both tokens, but the family id stays the same
+// from the password login until logout or revocation.
+type TokenFamily struct {
+	UserId      string
+	Realm       string
+	AccessUuid  string
+	RefreshUuid string
+}
+
+// RotatedToken is stored for a refresh token that was already used,
+// so that replaying it can be detected.
+type RotatedToken struct {
+	FamilyId  string
+	RotatedAt int64
 }
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"github.com/michibiki-io/ldap-jwt-go/utility/ldapc"
+)
+
+// groupList splits a semicolon separated list of group DNs,
+// commas cannot be used because they are part of a DN.
+func groupList(value string) []string {
+	groups := []string{}
+	for _, group := range strings.Split(value, ";") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// containsGroup compares the DNs case-insensitively.
+func containsGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMemberOf(user *model.User, groups []string) bool {
+	for _, group := range groups {
+		if containsGroup(user.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess rejects the user by the group lists and the access filter.
+// The groups are those resolved by getUser, including nested groups.
+func (r *realm) checkAccess(ctx context.Context, user *model.User) error {
+	if err := r.checkGroups(user); err != nil {
+		return err
+	}
+
+	// In the direct bind mode the access filter is checked only on login.
+	if r.accessFilter.String() != "" && r.canSearch() {
+		if entries, err := r.search(ctx, r.userBase, r.accessFilter.Build(ldapc.Values{ldapc.PlaceholderUsername: user.Id}), "1.1"); err != nil {
+			return err
+		} else if len(entries) < 1 {
+			utility.Log.Audit("access_denied", "userId: %s, reason: access filter", r.qualify(user.Id))
+			return utility.NewError(fmt.Sprintf("Access is denied"), utility.AccessDenied)
+		}
+	}
+
+	return nil
+}
+
+// checkGroups rejects the user by the group lists, without searching LDAP.
+func (r *realm) checkGroups(user *model.User) error {
+	// LDAP_DENY_GROUPS
+	// Semicolon separated DNs of groups whose members cannot log in
+	if deny := groupList(r.env("LDAP_DENY_GROUPS", "")); len(deny) > 0 && isMemberOf(user, deny) {
+		utility.Log.Audit("access_denied", "userId: %s, reason: deny group", r.qualify(user.Id))
+		return utility.NewError(fmt.Sprintf("Access is denied"), utility.AccessDenied)
+	}
+
+	// LDAP_ALLOW_GROUPS
+	// Semicolon separated DNs of groups, only their members can log in
+	if allow := groupList(r.env("LDAP_ALLOW_GROUPS", "")); len(allow) > 0 && !isMemberOf(user, allow) {
+		utility.Log.Audit("access_denied", "userId: %s, reason: not in allow groups", r.qualify(user.Id))
+		return utility.NewError(fmt.Sprintf("Access is denied"), utility.AccessDenied)
+	}
+
+	return nil
+}
+
+// checkAccessOnVerify runs checkAccess on /v1/verify when VERIFY_ACCESS_CHECK is enabled,
+// otherwise the access rules are checked only on login and refresh.
+func (r *realm) checkAccessOnVerify(ctx context.Context, user *model.User) error {
+	// VERIFY_ACCESS_CHECK
+	if !r.boolEnv("VERIFY_ACCESS_CHECK", false) {
+		return nil
+	}
+	return r.checkAccess(ctx, user)
+}
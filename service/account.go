@@ -0,0 +1,160 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"gopkg.in/ldap.v2"
+)
+
+// pwdAccountLockedTime of an account locked by an administrator
+const ppolicyLockedByAdmin = "000001010000Z"
+
+// accountCheck rejects the user entry when the account cannot log in.
+type accountCheck struct {
+	attributes []string // attributes of the user entry read by check
+	check      func(r *realm, entry *ldap.Entry) error
+}
+
+var accountChecks = map[string]accountCheck{
+	"nsAccountLock":        {[]string{"nsAccountLock"}, (*realm).checkNsAccountLock},
+	"pwdAccountLockedTime": {[]string{"pwdAccountLockedTime"}, (*realm).checkPwdAccountLockedTime},
+	"shadowExpire":         {[]string{"shadowExpire"}, (*realm).checkShadowExpire},
+	"accountExpires":       {[]string{"accountExpires"}, (*realm).checkAccountExpires},
+	"userAccountControl":   {[]string{"userAccountControl", adUserAccountControlComputed, "lockoutTime"}, (*realm).checkUserAccountControl},
+}
+
+// parseAccountChecks reads LDAP_ACCOUNT_CHECKS.
+func (r *realm) parseAccountChecks() error {
+	// LDAP_ACCOUNT_CHECKS
+	// Comma separated account status checks, see accountChecks
+	defaultChecks := ""
+	if r.isActiveDirectory() {
+		defaultChecks = "userAccountControl,accountExpires"
+	}
+
+	r.accountChecks = []accountCheck{}
+	for _, name := range strings.Split(r.env("LDAP_ACCOUNT_CHECKS", defaultChecks), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		} else if check, ok := accountChecks[name]; !ok {
+			return fmt.Errorf("unknown account check: %s", name)
+		} else {
+			r.accountChecks = append(r.accountChecks, check)
+		}
+	}
+	return nil
+}
+
+// accountAttributes returns the attributes read by the account checks.
+func (r *realm) accountAttributes() []string {
+	attributes := []string{}
+	for _, check := range r.accountChecks {
+		attributes = append(attributes, check.attributes...)
+	}
+	return attributes
+}
+
+// checkAccount rejects disabled, locked and expired accounts.
+func (r *realm) checkAccount(entry *ldap.Entry) error {
+	for _, check := range r.accountChecks {
+		if err := check.check(r, entry); err != nil {
+			utility.Log.Debug("Account is inactive, DN: %s, %v", entry.DN, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAccountForPasswordChange is checkAccount of a password change without
+// a token, entry is nil with a token. An expired password is let through,
+// changing it is what makes the account usable again.
+func (r *realm) checkAccountForPasswordChange(entry *ldap.Entry) error {
+	if entry == nil {
+		return nil
+	}
+	if err := r.checkAccount(entry); err != nil {
+		if e, ok := err.(*utility.Error); !ok || e.No() != utility.PasswordExpired {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNsAccountLock: 389 Directory Server and Oracle DSEE
+func (r *realm) checkNsAccountLock(entry *ldap.Entry) error {
+	if strings.EqualFold(entry.GetAttributeValue("nsAccountLock"), "true") {
+		return utility.NewError(fmt.Sprintf("Account is disabled"), utility.AccountDisabled)
+	}
+	return nil
+}
+
+// checkPwdAccountLockedTime: password policy overlay of OpenLDAP
+func (r *realm) checkPwdAccountLockedTime(entry *ldap.Entry) error {
+	value := entry.GetAttributeValue("pwdAccountLockedTime")
+	if value == "" {
+		return nil
+	} else if value == ppolicyLockedByAdmin {
+		return utility.NewError(fmt.Sprintf("Account is disabled"), utility.AccountDisabled)
+	}
+
+	// LDAP_LOCKOUT_DURATION
+	// pwdLockoutDuration of the password policy (minutes, 0: until an administrator unlocks)
+	duration := time.Duration(r.intEnv("LDAP_LOCKOUT_DURATION", 0)) * time.Minute
+	if lockedAt, err := time.Parse("20060102150405Z0700", value); err != nil || duration == 0 ||
+		time.Now().Before(lockedAt.Add(duration)) {
+		return utility.NewError(fmt.Sprintf("Account is locked"), utility.AccountLocked)
+	}
+	return nil
+}
+
+// checkShadowExpire: days since 1970-01-01 of shadowAccount, -1 or empty means never
+func (r *realm) checkShadowExpire(entry *ldap.Entry) error {
+	if days, err := strconv.ParseInt(entry.GetAttributeValue("shadowExpire"), 10, 64); err == nil && days >= 0 &&
+		!time.Now().Before(time.Unix(days*24*60*60, 0)) {
+		return utility.NewError(fmt.Sprintf("Account is expired"), utility.AccountExpired)
+	}
+	return nil
+}
+
+// checkAccountExpires: FILETIME of AD
+func (r *realm) checkAccountExpires(entry *ldap.Entry) error {
+	if expires, ok := fileTime(entry.GetAttributeValue("accountExpires")); ok && time.Now().After(expires) {
+		return utility.NewError(fmt.Sprintf("Account is expired"), utility.AccountExpired)
+	}
+	return nil
+}
+
+// checkUserAccountControl: flags of AD, and lockoutTime when the computed flags are not returned
+func (r *realm) checkUserAccountControl(entry *ldap.Entry) error {
+	if uac, err := strconv.ParseInt(entry.GetAttributeValue("userAccountControl"), 10, 64); err == nil && uac&adAccountDisable != 0 {
+		return utility.NewError(fmt.Sprintf("Account is disabled"), utility.AccountDisabled)
+	}
+
+	if value := entry.GetAttributeValue(adUserAccountControlComputed); value != "" {
+		if computed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			if computed&adLockout != 0 {
+				return utility.NewError(fmt.Sprintf("Account is locked"), utility.AccountLocked)
+			} else if computed&adPasswordExpired != 0 {
+				return utility.NewError(fmt.Sprintf("Password is expired"), utility.PasswordExpired)
+			}
+			return nil
+		}
+	}
+
+	// lockoutTime is set when the account is locked out, and kept after
+	// the lockout duration has passed until the next login.
+	if lockedAt, ok := fileTime(entry.GetAttributeValue("lockoutTime")); ok {
+		// LDAP_AD_LOCKOUT_DURATION
+		// Lockout duration of the domain policy (minutes, 0: until an administrator unlocks)
+		duration := time.Duration(r.intEnv("LDAP_AD_LOCKOUT_DURATION", 30)) * time.Minute
+		if duration == 0 || time.Now().Before(lockedAt.Add(duration)) {
+			return utility.NewError(fmt.Sprintf("Account is locked"), utility.AccountLocked)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"gopkg.in/ldap.v2"
+)
+
+// accountEntry returns a user entry with a single value of each attribute.
+func accountEntry(attributes map[string]string) *ldap.Entry {
+	values := map[string][]string{}
+	for name, value := range attributes {
+		values[name] = []string{value}
+	}
+	return ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", values)
+}
+
+func generalizedTime(t time.Time) string {
+	return t.UTC().Format("20060102150405Z")
+}
+
+func fileTimeOf(t time.Time) string {
+	return fmt.Sprint((t.Unix() + fileTimeEpochOffset) * 10000000)
+}
+
+// active is the want of an account which can log in.
+const active = ^utility.ErrorCode(0)
+
+// errorNo returns the error code of err, active when err is nil.
+func errorNo(err error) utility.ErrorCode {
+	if err == nil {
+		return active
+	} else if e, ok := err.(*utility.Error); ok {
+		return e.No()
+	}
+	return utility.InternalServerError
+}
+
+type accountTest struct {
+	name       string
+	attributes map[string]string
+	want       utility.ErrorCode
+}
+
+func runAccountTests(t *testing.T, check func(*ldap.Entry) error, tests []accountTest) {
+	t.Helper()
+	for _, test := range tests {
+		if got := errorNo(check(accountEntry(test.attributes))); got != test.want {
+			t.Errorf("%s: error no = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckNsAccountLock(t *testing.T) {
+	r := &realm{name: "accounttest"}
+	runAccountTests(t, r.checkNsAccountLock, []accountTest{
+		{"not set", map[string]string{}, active},
+		{"true", map[string]string{"nsAccountLock": "true"}, utility.AccountDisabled},
+		{"TRUE", map[string]string{"nsAccountLock": "TRUE"}, utility.AccountDisabled},
+		{"false", map[string]string{"nsAccountLock": "false"}, active},
+	})
+}
+
+func TestCheckPwdAccountLockedTime(t *testing.T) {
+	r := &realm{name: "accounttest"}
+	now := time.Now()
+	tests := []accountTest{
+		{"not set", map[string]string{}, active},
+		{"locked by an administrator", map[string]string{"pwdAccountLockedTime": ppolicyLockedByAdmin}, utility.AccountDisabled},
+		{"locked without a duration", map[string]string{"pwdAccountLockedTime": generalizedTime(now.Add(-24 * time.Hour))}, utility.AccountLocked},
+		{"unparsable", map[string]string{"pwdAccountLockedTime": "yesterday"}, utility.AccountLocked},
+	}
+	runAccountTests(t, r.checkPwdAccountLockedTime, tests)
+
+	t.Setenv("ACCOUNTTEST_LDAP_LOCKOUT_DURATION", "30")
+	runAccountTests(t, r.checkPwdAccountLockedTime, []accountTest{
+		{"locked within the duration", map[string]string{"pwdAccountLockedTime": generalizedTime(now.Add(-10 * time.Minute))}, utility.AccountLocked},
+		{"locked with an offset", map[string]string{"pwdAccountLockedTime": now.Add(-10 * time.Minute).In(time.FixedZone("JST", 9*60*60)).Format("20060102150405-0700")}, utility.AccountLocked},
+		{"lockout passed", map[string]string{"pwdAccountLockedTime": generalizedTime(now.Add(-time.Hour))}, active},
+		{"locked by an administrator", map[string]string{"pwdAccountLockedTime": ppolicyLockedByAdmin}, utility.AccountDisabled},
+	})
+}
+
+func TestCheckShadowExpire(t *testing.T) {
+	r := &realm{name: "accounttest"}
+	today := time.Now().Unix() / (24 * 60 * 60)
+	runAccountTests(t, r.checkShadowExpire, []accountTest{
+		{"not set", map[string]string{}, active},
+		{"never", map[string]string{"shadowExpire": "-1"}, active},
+		{"unparsable", map[string]string{"shadowExpire": "never"}, active},
+		{"epoch", map[string]string{"shadowExpire": "0"}, utility.AccountExpired},
+		{"yesterday", map[string]string{"shadowExpire": fmt.Sprint(today - 1)}, utility.AccountExpired},
+		{"today", map[string]string{"shadowExpire": fmt.Sprint(today)}, utility.AccountExpired},
+		{"tomorrow", map[string]string{"shadowExpire": fmt.Sprint(today + 1)}, active},
+	})
+}
+
+func TestCheckAccountExpires(t *testing.T) {
+	r := &realm{name: "accounttest"}
+	now := time.Now()
+	runAccountTests(t, r.checkAccountExpires, []accountTest{
+		{"not set", map[string]string{}, active},
+		{"never (0)", map[string]string{"accountExpires": "0"}, active},
+		{"never (maximum)", map[string]string{"accountExpires": "9223372036854775807"}, active},
+		{"passed", map[string]string{"accountExpires": fileTimeOf(now.Add(-time.Hour))}, utility.AccountExpired},
+		{"future", map[string]string{"accountExpires": fileTimeOf(now.Add(time.Hour))}, active},
+	})
+}
+
+func TestCheckUserAccountControl(t *testing.T) {
+	r := &realm{name: "accounttest"}
+	now := time.Now()
+	runAccountTests(t, r.checkUserAccountControl, []accountTest{
+		{"normal account", map[string]string{"userAccountControl": "512"}, active},
+		{"disabled", map[string]string{"userAccountControl": "514"}, utility.AccountDisabled},
+		{"disabled and computed locked", map[string]string{"userAccountControl": "514", adUserAccountControlComputed: "16"}, utility.AccountDisabled},
+		{"lockout flag of userAccountControl is ignored", map[string]string{"userAccountControl": "528", adUserAccountControlComputed: "0"}, active},
+		{"computed locked", map[string]string{"userAccountControl": "512", adUserAccountControlComputed: "16"}, utility.AccountLocked},
+		{"computed password expired", map[string]string{"userAccountControl": "512", adUserAccountControlComputed: "8388608"}, utility.PasswordExpired},
+		{"computed locked and password expired", map[string]string{"userAccountControl": "512", adUserAccountControlComputed: "8388624"}, utility.AccountLocked},
+		{"computed flags win over lockoutTime", map[string]string{"userAccountControl": "512", adUserAccountControlComputed: "0", "lockoutTime": fileTimeOf(now.Add(-time.Minute))}, active},
+		{"lockoutTime within the duration", map[string]string{"userAccountControl": "512", "lockoutTime": fileTimeOf(now.Add(-time.Minute))}, utility.AccountLocked},
+		{"lockoutTime passed", map[string]string{"userAccountControl": "512", "lockoutTime": fileTimeOf(now.Add(-time.Hour))}, active},
+		{"lockoutTime 0", map[string]string{"userAccountControl": "512", "lockoutTime": "0"}, active},
+		{"not set", map[string]string{}, active},
+	})
+
+	t.Setenv("ACCOUNTTEST_LDAP_AD_LOCKOUT_DURATION", "0")
+	runAccountTests(t, r.checkUserAccountControl, []accountTest{
+		{"lockoutTime until unlocked", map[string]string{"userAccountControl": "512", "lockoutTime": fileTimeOf(now.Add(-24 * time.Hour))}, utility.AccountLocked},
+	})
+}
+
+func TestCheckAccountForPasswordChange(t *testing.T) {
+	r := &realm{name: "accounttest", accountChecks: []accountCheck{accountChecks["userAccountControl"]}}
+	runAccountTests(t, r.checkAccountForPasswordChange, []accountTest{
+		{"normal account", map[string]string{"userAccountControl": "512"}, active},
+		{"password expired", map[string]string{"userAccountControl": "512", adUserAccountControlComputed: "8388608"}, active},
+		{"locked", map[string]string{"userAccountControl": "512", adUserAccountControlComputed: "16"}, utility.AccountLocked},
+		{"disabled", map[string]string{"userAccountControl": "514"}, utility.AccountDisabled},
+	})
+	if err := r.checkAccountForPasswordChange(nil); err != nil {
+		t.Errorf("checkAccountForPasswordChange(nil) = %v, want nil", err)
+	}
+}
+
+func TestParseAccountChecks(t *testing.T) {
+	r := &realm{name: "accounttest"}
+	t.Setenv("ACCOUNTTEST_LDAP_ACCOUNT_CHECKS", "nsAccountLock, shadowExpire")
+	if err := r.parseAccountChecks(); err != nil {
+		t.Fatal(err)
+	} else if len(r.accountChecks) != 2 {
+		t.Errorf("%d account checks are parsed, want 2", len(r.accountChecks))
+	}
+
+	t.Setenv("ACCOUNTTEST_LDAP_ACCOUNT_CHECKS", "nsAccountLock,unknown")
+	if err := r.parseAccountChecks(); err == nil {
+		t.Errorf("an unknown account check is accepted")
+	}
+}
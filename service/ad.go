@@ -0,0 +1,74 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// userAccountControl flags. AD stores only the disable flag in userAccountControl,
+// the lockout and password expired flags are set in adUserAccountControlComputed.
+const (
+	adAccountDisable  = 0x0002
+	adLockout         = 0x0010
+	adPasswordExpired = 0x800000
+)
+
+// Constructed attribute with the lockout and password expired flags,
+// it is returned only when requested explicitly
+const adUserAccountControlComputed = "msDS-User-Account-Control-Computed"
+
+// LDAP_MATCHING_RULE_IN_CHAIN resolves nested group membership on AD
+const adMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// Seconds between 1601-01-01 (Windows FILETIME epoch) and 1970-01-01
+const fileTimeEpochOffset = 11644473600
+
+const (
+	adDefaultFilterObject = "(&(objectCategory=person)(objectClass=user))"
+	adDefaultFilterUser   = "(&(objectCategory=person)(objectClass=user)(|(sAMAccountName={username})(userPrincipalName={username})))"
+	adDefaultFilterGroup  = "(&(objectClass=group)(member:" + adMatchingRuleInChain + ":={dn}))"
+)
+
+// Attributes of the user entry used in AD mode
+// (the account status is read by the account checks)
+var adUserAttributes = []string{"sAMAccountName", "memberOf"}
+
+// LDAP_SERVER_TYPE
+// LDAP (OpenLDAP and others) or AD (Active Directory)
+func (r *realm) isActiveDirectory() bool {
+	return r.env("LDAP_SERVER_TYPE", "LDAP") == "AD"
+}
+
+// LDAP_AD_GROUPS
+// MEMBER_OF reads direct groups from memberOf of the user entry,
+// IN_CHAIN searches nested groups with LDAP_FILTER_GROUP
+func (r *realm) adGroupsFromMemberOf() bool {
+	return r.env("LDAP_AD_GROUPS", "IN_CHAIN") == "MEMBER_OF"
+}
+
+// normalizeAdUsername turns DOMAIN\user into user, and user@domain into
+// user when domain is LDAP_AD_DOMAIN. Other UPNs are kept as they are.
+func (r *realm) normalizeAdUsername(username string) string {
+	if i := strings.LastIndex(username, `\`); i >= 0 {
+		return username[i+1:]
+	}
+
+	// LDAP_AD_DOMAIN
+	// UPN suffix which is removed from user@domain
+	if domain := r.env("LDAP_AD_DOMAIN", ""); domain != "" {
+		if i := strings.LastIndex(username, "@"); i >= 0 && strings.EqualFold(username[i+1:], domain) {
+			return username[:i]
+		}
+	}
+	return username
+}
+
+// fileTime converts a Windows FILETIME attribute. 0 and the maximum value mean never.
+func fileTime(value string) (time.Time, bool) {
+	ft, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ft <= 0 || ft == 0x7FFFFFFFFFFFFFFF {
+		return time.Time{}, false
+	}
+	return time.Unix(ft/10000000-fileTimeEpochOffset, 0), true
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+		ok    bool
+	}{
+		{"116444736000000000", time.Unix(0, 0), true},
+		{"133485408000000000", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"0", time.Time{}, false},
+		{"9223372036854775807", time.Time{}, false},
+		{"", time.Time{}, false},
+		{"never", time.Time{}, false},
+		{"-1", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := fileTime(test.value)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("fileTime(%q) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestNormalizeAdUsername(t *testing.T) {
+	r := &realm{name: "adtest"}
+	t.Setenv("ADTEST_LDAP_AD_DOMAIN", "example.com")
+
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"alice", "alice"},
+		{`EXAMPLE\alice`, "alice"},
+		{"alice@example.com", "alice"},
+		{"alice@EXAMPLE.COM", "alice"},
+		{"alice@other.example.com", "alice@other.example.com"},
+		{"alice@example.com@evil.com", "alice@example.com@evil.com"},
+	}
+	for _, test := range tests {
+		if got := r.normalizeAdUsername(test.username); got != test.want {
+			t.Errorf("normalizeAdUsername(%q) = %q, want %q", test.username, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+)
+
+const userCacheKeyPrefix = "user:"
+
+// cachedUser is stored for both found and unknown users,
+// unknown users are cached with Found = false.
+type cachedUser struct {
+	Found bool
+	User  model.User
+}
+
+// userCacheKey takes a user id qualified by the realm.
+func userCacheKey(qualifiedId string) string {
+	return userCacheKeyPrefix + qualifiedId
+}
+
+// getCachedUser returns the user from the cache, or looks it up in LDAP
+// and caches the result.
+func (r *realm) getCachedUser(ctx context.Context, userId string) (user model.User, error error) {
+	user = model.User{}
+	error = nil
+
+	// USER_CACHE_TTL
+	// Seconds to cache found users (0: disabled)
+	ttl := time.Duration(utility.GetIntEnv("USER_CACHE_TTL", 0)) * time.Second
+	if ttl <= 0 {
+		return r.getUser(ctx, userId)
+	}
+
+	cached := cachedUser{}
+	if jsonObj, err := redisClient.Get(userCacheKey(r.qualify(userId))).Result(); err == nil {
+		if err := json.Unmarshal([]byte(jsonObj), &cached); err == nil {
+			if cached.Found {
+				user = cached.User
+			} else {
+				error = utility.NewError("LDAP Authenticate failed: user is not found", utility.Unauthorized)
+			}
+			return
+		}
+		utility.Log.Debug("system cannot unmarshal the cached user, userId: %s", userId)
+	}
+
+	if user, error = r.getUser(ctx, userId); error == nil {
+		cacheUser(&user)
+	} else if err, ok := error.(*utility.Error); ok && err.No() == utility.Unauthorized {
+		cacheUnknownUser(r.qualify(userId))
+	}
+	return
+}
+
+// cacheUser stores a freshly looked up user.
+func cacheUser(user *model.User) {
+	ttl := time.Duration(utility.GetIntEnv("USER_CACHE_TTL", 0)) * time.Second
+	if ttl <= 0 {
+		return
+	}
+
+	if jsonObj, err := json.Marshal(cachedUser{Found: true, User: *user}); err == nil {
+		if err := redisClient.Set(userCacheKey(qualifiedUserId(user.Realm, user.Id)), jsonObj, ttl).Err(); err != nil {
+			utility.Log.Debug("Caching user is failed, userId: %s", user.Id)
+		}
+	}
+}
+
+// cacheUnknownUser remembers that the user does not exist in LDAP.
+func cacheUnknownUser(qualifiedId string) {
+	// USER_CACHE_NEGATIVE_TTL
+	// Seconds to cache unknown users (0: disabled)
+	ttl := time.Duration(utility.GetIntEnv("USER_CACHE_NEGATIVE_TTL", 0)) * time.Second
+	if ttl <= 0 {
+		return
+	}
+
+	if jsonObj, err := json.Marshal(cachedUser{Found: false}); err == nil {
+		if err := redisClient.Set(userCacheKey(qualifiedId), jsonObj, ttl).Err(); err != nil {
+			utility.Log.Debug("Caching unknown user is failed, userId: %s", qualifiedId)
+		}
+	}
+}
+
+// invalidateUser drops the cached user, qualifiedId is qualified by the realm.
+func invalidateUser(qualifiedId string) {
+	if qualifiedId == "" {
+		return
+	}
+	if err := redisClient.Del(userCacheKey(qualifiedId)).Err(); err != nil {
+		utility.Log.Debug("Invalidating cached user is failed, userId: %s", qualifiedId)
+	}
+}
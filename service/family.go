@@ -0,0 +1,135 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+)
+
+const (
+	familyKeyPrefix       = "family:"
+	rotatedKeyPrefix      = "rotated:"
+	userSessionsKeyPrefix = "sessions:"
+)
+
+func familyKey(familyId string) string {
+	return familyKeyPrefix + familyId
+}
+
+func rotatedKey(uuid string) string {
+	return rotatedKeyPrefix + uuid
+}
+
+// userSessionsKey is a set of the family ids of the user,
+// qualifiedId is qualified by the realm.
+func userSessionsKey(qualifiedId string) string {
+	return userSessionsKeyPrefix + qualifiedId
+}
+
+// detectReuse checks whether the refresh token was already rotated.
+// Outside of the grace window the whole family is revoked.
+func detectReuse(token *model.Token) (reused bool, error error) {
+	reused = false
+	error = nil
+
+	rotated := model.RotatedToken{}
+	if jsonObj, err := redisClient.Get(rotatedKey(token.Uuid)).Result(); err != nil {
+		return
+	} else if err := json.Unmarshal([]byte(jsonObj), &rotated); err != nil {
+		utility.Log.Debug("system cannot unmarshal the rotated token, UUID: %s", token.Uuid)
+		return
+	}
+
+	reused = true
+
+	// REFRESH_REUSE_GRACE
+	// Seconds in which a rotated refresh token is rejected without revoking the family
+	grace := time.Duration(utility.GetIntEnv("REFRESH_REUSE_GRACE", 0)) * time.Second
+	if time.Since(time.Unix(rotated.RotatedAt, 0)) < grace {
+		utility.Log.Debug("Rotated refresh token is used within grace window, UUID: %s", token.Uuid)
+		error = utility.NewError(fmt.Sprintf("Token is invalid"), utility.Unauthorized)
+		return
+	}
+
+	utility.Log.Audit("refresh_token_reuse", "family: %s, uuid: %s", rotated.FamilyId, token.Uuid)
+	if err := revokeFamily(rotated.FamilyId, model.RevokeReasonReuse); err != nil {
+		utility.Log.Debug("Revoking token family is failed, family: %s", rotated.FamilyId)
+	}
+	error = utility.NewError(fmt.Sprintf("Refresh token reuse is detected"), utility.Unauthorized)
+	return
+}
+
+// revokeFamily deletes the current access and refresh tokens of the family.
+func revokeFamily(familyId string, reason string) error {
+	family := model.TokenFamily{}
+	for attempt := 0; ; attempt++ {
+		if jsonObj, err := redisClient.Get(familyKey(familyId)).Result(); err != nil {
+			return err
+		} else if err := json.Unmarshal([]byte(jsonObj), &family); err != nil {
+			return err
+		}
+		_, err := revokeFamilyScript.Run(redisClient, []string{familyKey(familyId), family.AccessUuid, family.RefreshUuid}).Result()
+		if err == nil {
+			break
+		} else if err != redis.Nil || attempt >= 2 {
+			// redis.Nil: the family was rotated meanwhile, read it again
+			return err
+		}
+	}
+
+	qualifiedId := qualifiedUserId(family.Realm, family.UserId)
+	redisClient.SRem(userSessionsKey(qualifiedId), familyId)
+	invalidateUser(qualifiedId)
+	publishRevocation(reason, family.AccessUuid, family.RefreshUuid)
+
+	utility.Log.Audit("token_family_revoked", "family: %s, reason: %s", familyId, reason)
+	return nil
+}
+
+// revokeUserSessions revokes every session of the user except exceptFamilyId,
+// qualifiedId is qualified by the realm.
+func revokeUserSessions(qualifiedId string, exceptFamilyId string, reason string) {
+	familyIds, err := redisClient.SMembers(userSessionsKey(qualifiedId)).Result()
+	if err != nil {
+		utility.Log.Debug("Reading sessions of the user is failed, userId: %s", qualifiedId)
+		return
+	}
+
+	for _, familyId := range familyIds {
+		if familyId == exceptFamilyId {
+			continue
+		}
+		if err := revokeFamily(familyId, reason); err != nil {
+			// the family is already expired or logged out
+			redisClient.SRem(userSessionsKey(qualifiedId), familyId)
+		}
+	}
+}
+
+// checkSession enforces the absolute session lifetime since the password
+// login and the idle timeout since the last issued token.
+func checkSession(storedAuth *model.StoredAuth) error {
+	now := time.Now()
+
+	// SESSION_MAX_AGE
+	// Minutes a session may be refreshed after the password login (0: unlimited)
+	if maxAge := utility.GetIntEnv("SESSION_MAX_AGE", 0); maxAge > 0 && storedAuth.AuthTime > 0 &&
+		now.Sub(time.Unix(storedAuth.AuthTime, 0)) > time.Duration(maxAge)*time.Minute {
+		utility.Log.Debug("Session reached max age, family: %s", storedAuth.FamilyId)
+		return utility.NewError(fmt.Sprintf("Session is expired"), utility.Expired)
+	}
+
+	// SESSION_IDLE_TIMEOUT
+	// Minutes a session may stay without refresh (0: unlimited)
+	if idle := utility.GetIntEnv("SESSION_IDLE_TIMEOUT", 0); idle > 0 && storedAuth.IssuedAt > 0 &&
+		now.Sub(time.Unix(storedAuth.IssuedAt, 0)) > time.Duration(idle)*time.Minute {
+		utility.Log.Debug("Session reached idle timeout, family: %s", storedAuth.FamilyId)
+		return utility.NewError(fmt.Sprintf("Session is expired"), utility.Expired)
+	}
+
+	return nil
+}
@@ -0,0 +1,264 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"github.com/michibiki-io/ldap-jwt-go/utility/ldapc"
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	groupCacheKeyPrefix     = "group:"
+	groupNameCacheKeyPrefix = "groupname:"
+)
+
+func groupCacheKey(realmName, groupDn string) string {
+	return groupCacheKeyPrefix + qualifiedUserId(realmName, groupDn)
+}
+
+func groupNameCacheKey(realmName, groupDn string) string {
+	return groupNameCacheKeyPrefix + qualifiedUserId(realmName, groupDn)
+}
+
+// LDAP_FILTER_GROUP
+// {member} is replaced by LDAP_GROUP_MEMBER_ATTRIBUTE of the user, see userValues
+func (r *realm) groupFilterTemplate() string {
+	if r.isActiveDirectory() {
+		return r.env("LDAP_FILTER_GROUP", adDefaultFilterGroup)
+	}
+	return r.env("LDAP_FILTER_GROUP", "(&(objectClass=groupOfNames)(member={dn}))")
+}
+
+// LDAP_GROUP_MEMBER_ATTRIBUTE
+// Attribute of the user for {member}, e.g. uid for memberUid of posixGroup
+func (r *realm) groupMemberAttribute() string {
+	return r.env("LDAP_GROUP_MEMBER_ATTRIBUTE", "dn")
+}
+
+// LDAP_PRIMARY_GROUP
+// Add the group of gidNumber of the user, found by LDAP_FILTER_PRIMARY_GROUP
+func (r *realm) primaryGroupEnabled() bool {
+	return r.boolEnv("LDAP_PRIMARY_GROUP", false)
+}
+
+// groupValueAttributes returns the attributes of the user used by the group filters.
+func (r *realm) groupValueAttributes() []string {
+	attributes := []string{}
+	for _, attribute := range []string{ldapc.PlaceholderUid, ldapc.PlaceholderUidNumber, ldapc.PlaceholderGidNumber} {
+		// the placeholders are named after the attributes
+		if r.groupFilter.Uses(attribute) || r.primaryGroupFilter.Uses(attribute) {
+			attributes = append(attributes, attribute)
+		}
+	}
+	if attribute := r.groupMemberAttribute(); attribute != "dn" &&
+		(r.groupFilter.Uses(ldapc.PlaceholderMember) || r.primaryGroupFilter.Uses(ldapc.PlaceholderMember)) {
+		attributes = append(attributes, attribute)
+	}
+	return attributes
+}
+
+// userValues returns the values of the placeholders of the group filters.
+func (r *realm) userValues(userId string, entry *ldap.Entry) ldapc.Values {
+	values := ldapc.Values{
+		ldapc.PlaceholderUsername: userId,
+		ldapc.PlaceholderDN:       entry.DN,
+		ldapc.PlaceholderMember:   entry.DN,
+	}
+	for _, attribute := range []string{ldapc.PlaceholderUid, ldapc.PlaceholderUidNumber, ldapc.PlaceholderGidNumber} {
+		values[attribute] = entry.GetAttributeValue(attribute)
+	}
+	if attribute := r.groupMemberAttribute(); attribute != "dn" {
+		values[ldapc.PlaceholderMember] = entry.GetAttributeValue(attribute)
+	}
+	return values
+}
+
+// userGroups returns the DNs of the groups of the user entry,
+// and the primary group when LDAP_PRIMARY_GROUP is enabled.
+func (r *realm) userGroups(ctx context.Context, userId string, entry *ldap.Entry) ([]string, error) {
+	values := r.userValues(userId, entry)
+
+	groups := []string{}
+	entries, err := r.search(ctx, r.groupBase, r.groupFilter.Build(values), r.groupAttributes()...)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range entries {
+		groups = append(groups, group.DN)
+	}
+	r.cacheGroupNames(entries)
+
+	if r.primaryGroupEnabled() && values[ldapc.PlaceholderGidNumber] != "" {
+		if entries, err = r.search(ctx, r.groupBase, r.primaryGroupFilter.Build(values), r.groupAttributes()...); err != nil {
+			return nil, err
+		}
+		for _, group := range entries {
+			if !containsGroup(groups, group.DN) {
+				groups = append(groups, group.DN)
+			}
+		}
+		r.cacheGroupNames(entries)
+	}
+
+	return groups, nil
+}
+
+// groupAttributes returns the attributes read from group entries,
+// the attribute of LDAP_GROUP_FORMAT is read together with the DN.
+func (r *realm) groupAttributes() []string {
+	if format := r.groupFormat(); format != "dn" && format != "cn" {
+		return []string{format}
+	}
+	// only the DN
+	return []string{"1.1"}
+}
+
+// GROUP_NAME_CACHE_TTL
+// Seconds to cache the names of LDAP_GROUP_FORMAT (0: disabled)
+func groupNameCacheTTL() time.Duration {
+	return time.Duration(utility.GetIntEnv("GROUP_NAME_CACHE_TTL", 3600)) * time.Second
+}
+
+// cacheGroupNames stores the names read by a group search for groupName.
+func (r *realm) cacheGroupNames(entries []*ldap.Entry) {
+	format, ttl := r.groupFormat(), groupNameCacheTTL()
+	if format == "dn" || format == "cn" || ttl <= 0 {
+		return
+	}
+	for _, entry := range entries {
+		if name := entry.GetAttributeValue(format); name != "" {
+			redisClient.Set(groupNameCacheKey(r.name, entry.DN), name, ttl)
+		}
+	}
+}
+
+// LDAP_NESTED_GROUPS
+// Add the groups which contain the groups of the user
+func (r *realm) nestedGroupsEnabled() bool {
+	return r.boolEnv("LDAP_NESTED_GROUPS", false)
+}
+
+// expandNestedGroups adds the parent groups of groups, level by level,
+// until no new group is found or LDAP_NESTED_GROUPS_DEPTH is reached.
+// Groups already seen are skipped, so membership cycles terminate.
+// A failed search fails the expansion, a truncated list could miss a deny group.
+func (r *realm) expandNestedGroups(ctx context.Context, groups []string) ([]string, error) {
+	// LDAP_NESTED_GROUPS_DEPTH
+	maxDepth := r.intEnv("LDAP_NESTED_GROUPS_DEPTH", 5)
+
+	seen := map[string]bool{}
+	for _, group := range groups {
+		seen[group] = true
+	}
+
+	result := append([]string{}, groups...)
+	current := groups
+	for depth := 0; depth < maxDepth && len(current) > 0; depth++ {
+		next := []string{}
+		for _, group := range current {
+			parents, err := r.parentGroups(ctx, group)
+			if err != nil {
+				utility.Log.Debug("Searching parent groups is failed, group: %s, %v", group, err)
+				return nil, err
+			}
+			for _, parent := range parents {
+				if !seen[parent] {
+					seen[parent] = true
+					next = append(next, parent)
+				}
+			}
+		}
+		result = append(result, next...)
+		current = next
+	}
+	if len(current) > 0 {
+		utility.Log.Debug("Nested groups are truncated at depth %d", maxDepth)
+	}
+
+	return result, nil
+}
+
+// parentGroups returns the groups which have groupDn as a member.
+func (r *realm) parentGroups(ctx context.Context, groupDn string) ([]string, error) {
+	// GROUP_CACHE_TTL
+	// Seconds to cache parent groups of a group (0: disabled)
+	ttl := time.Duration(utility.GetIntEnv("GROUP_CACHE_TTL", 0)) * time.Second
+
+	parents := []string{}
+	if ttl > 0 {
+		if jsonObj, err := redisClient.Get(groupCacheKey(r.name, groupDn)).Result(); err == nil {
+			if err := json.Unmarshal([]byte(jsonObj), &parents); err == nil {
+				return parents, nil
+			}
+		}
+	}
+
+	entries, err := r.search(ctx, r.groupBase, r.groupFilter.Build(ldapc.Values{ldapc.PlaceholderDN: groupDn, ldapc.PlaceholderMember: groupDn}), r.groupAttributes()...)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		parents = append(parents, entry.DN)
+	}
+	r.cacheGroupNames(entries)
+
+	if ttl > 0 {
+		if jsonObj, err := json.Marshal(parents); err == nil {
+			redisClient.Set(groupCacheKey(r.name, groupDn), jsonObj, ttl)
+		}
+	}
+	return parents, nil
+}
+
+// LDAP_GROUP_FORMAT
+// Groups returned by /v1/verify: dn, cn (the first RDN of the DN) or an attribute of the group
+func (r *realm) groupFormat() string {
+	return r.env("LDAP_GROUP_FORMAT", "dn")
+}
+
+// formatGroups converts the group DNs by LDAP_GROUP_FORMAT.
+// The DNs are kept internally for the access rules and nested groups.
+func (r *realm) formatGroups(ctx context.Context, groups []string) []string {
+	format := r.groupFormat()
+	if format == "dn" {
+		return groups
+	}
+
+	names := []string{}
+	for _, group := range groups {
+		names = append(names, r.groupName(ctx, group, format))
+	}
+	return names
+}
+
+// groupName returns the name of the group, or the DN when it has no such name.
+func (r *realm) groupName(ctx context.Context, groupDn string, format string) string {
+	if format == "cn" {
+		if dn, err := ldap.ParseDN(groupDn); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			return dn.RDNs[0].Attributes[0].Value
+		}
+		return groupDn
+	}
+
+	ttl := groupNameCacheTTL()
+	if ttl > 0 {
+		if name, err := redisClient.Get(groupNameCacheKey(r.name, groupDn)).Result(); err == nil {
+			return name
+		}
+	}
+
+	entries, err := r.search(ctx, ldapc.Base{DN: groupDn, Scope: ldapc.ScopeBase}, "(objectClass=*)", format)
+	if err != nil || len(entries) < 1 || entries[0].GetAttributeValue(format) == "" {
+		utility.Log.Debug("Reading %s of the group is failed, group: %s, %v", format, groupDn, err)
+		return groupDn
+	}
+
+	name := entries[0].GetAttributeValue(format)
+	if ttl > 0 {
+		redisClient.Set(groupNameCacheKey(r.name, groupDn), name, ttl)
+	}
+	return name
+}
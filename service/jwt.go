@@ -29,7 +29,7 @@ func init() {
 
 type JwtService struct{}
 
-func (*JwtService) CreateToken(signKey *rsa.PrivateKey, expiration int) (stToken model.Token, createError error) {
+func (*JwtService) CreateToken(signKey *rsa.PrivateKey, expiration int, realm string) (stToken model.Token, createError error) {
 
 	stToken = model.Token{}
 	createError = nil
@@ -43,6 +43,9 @@ func (*JwtService) CreateToken(signKey *rsa.PrivateKey, expiration int) (stToken
 	//expired := time.Now().UTC().Add(time.Second * time.Duration(expiration)).Unix()
 	claims["exp"] = expired
 	claims["uuid"] = uuid.NewV4().String()
+	if realm != "" {
+		claims["realm"] = realm
+	}
 
 	if stToken.Token, createError = token.SignedString(signKey); createError != nil {
 		return
@@ -50,6 +53,7 @@ func (*JwtService) CreateToken(signKey *rsa.PrivateKey, expiration int) (stToken
 		createError = nil
 		stToken.Expires = expired
 		stToken.Uuid = claims["uuid"].(string)
+		stToken.Realm = realm
 		return
 	}
 }
@@ -80,6 +84,8 @@ func (*JwtService) VerifyToken(verifyKey *rsa.PublicKey, tokenString string) (st
 			if stToken.Uuid, ok = claims["uuid"].(string); !ok {
 				verifyError = utility.NewError(fmt.Sprintf("Unexpected uuid data type."), utility.UnprocessableEntity)
 			}
+			// the realm is omitted for the unnamed realm
+			stToken.Realm, _ = claims["realm"].(string)
 			return
 		}
 	} else if ve, ok := err.(*jwt.ValidationError); ok {
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"github.com/michibiki-io/ldap-jwt-go/utility/ldapc"
+)
+
+type MetricsService struct{}
+
+// LdapRealm is the LDAP metrics of a realm.
+type LdapRealm struct {
+	Realm      string               `json:"realm"`
+	Servers    []ldapc.ServerStatus `json:"servers"`
+	SearchPool ldapc.PoolStats      `json:"search_pool"`
+	BindPool   ldapc.PoolStats      `json:"bind_pool"`
+	Breaker    ldapc.BreakerStatus  `json:"breaker"`
+}
+
+// LdapRealms returns the health of the LDAP servers and metrics of the
+// LDAP connection pools of every realm.
+func (*MetricsService) LdapRealms() []LdapRealm {
+	result := []LdapRealm{}
+	for _, r := range realms {
+		search, bind := r.ldapClient.Stats()
+		result = append(result, LdapRealm{
+			Realm:      r.name,
+			Servers:    r.ldapClient.ServerStatus(),
+			SearchPool: search,
+			BindPool:   bind,
+			Breaker:    r.ldapClient.BreakerStatus(),
+		})
+	}
+	return result
+}
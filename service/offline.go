@@ -0,0 +1,234 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	offlineCacheKeyPrefix   = "offline:"
+	offlineLoginsKeyPrefix  = "offlinelogins:"
+	offlineFailureKeyPrefix = "offlinefailures:"
+)
+
+// argon2id parameters, the second recommended option of RFC 9106
+const (
+	offlineHashTime    = 3
+	offlineHashMemory  = 64 * 1024
+	offlineHashThreads = 4
+	offlineHashLength  = 32
+	offlineSaltLength  = 16
+)
+
+// offlineHashSlots limits the concurrent hashing of offline logins, and
+// offlineStoreSlots that of the online logins which store the credentials.
+// Each hash takes offlineHashMemory KiB.
+var (
+	offlineHashSlots  chan struct{}
+	offlineStoreSlots chan struct{}
+)
+
+func init() {
+	// OFFLINE_LOGIN_CONCURRENCY
+	// Maximum passwords hashed at the same time for offline logins, and for storing them
+	slots := utility.GetIntEnv("OFFLINE_LOGIN_CONCURRENCY", 4)
+	if slots < 1 {
+		slots = 1
+	}
+	offlineHashSlots = make(chan struct{}, slots)
+	offlineStoreSlots = make(chan struct{}, slots)
+}
+
+// offlineCredential is the argon2id hash of the password of the last
+// successful login and the user resolved by it.
+type offlineCredential struct {
+	Salt    []byte
+	Hash    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	User    model.User
+}
+
+// offlineCacheKey takes the login name qualified by the realm, not the user id,
+// because the directory cannot resolve the login name to the user id offline.
+func offlineCacheKey(realmName, loginName string) string {
+	return offlineCacheKeyPrefix + qualifiedUserId(realmName, loginName)
+}
+
+// offlineFailureKey counts the failed offline logins of the login name.
+func offlineFailureKey(realmName, loginName string) string {
+	return offlineFailureKeyPrefix + qualifiedUserId(realmName, loginName)
+}
+
+// offlineLoginsKey is the set of the login names of the user, qualifiedId is
+// qualified by the realm.
+func offlineLoginsKey(qualifiedId string) string {
+	return offlineLoginsKeyPrefix + qualifiedId
+}
+
+// LDAP_OFFLINE_LOGIN
+// Accept the password of the last successful login while LDAP is unavailable
+func (r *realm) offlineLoginEnabled() bool {
+	return r.boolEnv("LDAP_OFFLINE_LOGIN", false)
+}
+
+// storeOfflineCredential remembers the password and the user of a successful
+// login. The password is hashed in the background, so the login does not wait
+// for it. While all offlineStoreSlots are busy the stored credential is dropped
+// instead, it may hold a password which has been changed in the directory.
+func (r *realm) storeOfflineCredential(loginName, password string, user *model.User) {
+	if !r.offlineLoginEnabled() || password == "" {
+		return
+	}
+
+	select {
+	case offlineStoreSlots <- struct{}{}:
+	default:
+		utility.Log.Debug("Storing offline credential is skipped as busy, login: %s", loginName)
+		redisClient.Del(offlineCacheKey(r.name, loginName))
+		return
+	}
+	stored := *user
+	go func() {
+		defer func() { <-offlineStoreSlots }()
+		r.hashOfflineCredential(loginName, password, &stored)
+	}()
+}
+
+func (r *realm) hashOfflineCredential(loginName, password string, user *model.User) {
+	// LDAP_OFFLINE_LOGIN_TTL
+	// Seconds the credentials are accepted after the last successful login
+	ttl := time.Duration(r.intEnv("LDAP_OFFLINE_LOGIN_TTL", 60*60*24)) * time.Second
+
+	credential := offlineCredential{
+		Salt:    make([]byte, offlineSaltLength),
+		Time:    offlineHashTime,
+		Memory:  offlineHashMemory,
+		Threads: offlineHashThreads,
+		User:    *user,
+	}
+	if _, err := rand.Read(credential.Salt); err != nil {
+		utility.Log.Debug("Generating salt is failed, userId: %s", r.qualify(user.Id))
+		return
+	}
+	credential.Hash = argon2.IDKey([]byte(password), credential.Salt,
+		credential.Time, credential.Memory, credential.Threads, offlineHashLength)
+
+	jsonObj, err := json.Marshal(credential)
+	if err != nil {
+		return
+	}
+	loginsKey := offlineLoginsKey(r.qualify(user.Id))
+	if _, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(offlineCacheKey(r.name, loginName), jsonObj, ttl)
+		pipe.SAdd(loginsKey, loginName)
+		pipe.Expire(loginsKey, ttl)
+		pipe.Del(offlineFailureKey(r.name, loginName))
+		return nil
+	}); err != nil {
+		utility.Log.Debug("Storing offline credential is failed, userId: %s", r.qualify(user.Id))
+	}
+}
+
+// offlineUser returns the user when password matches the stored credential.
+// After LDAP_OFFLINE_LOGIN_MAX_FAILURES failed attempts the login name is not
+// accepted offline until it logs in online again, and nothing is hashed while
+// all offlineHashSlots are busy.
+func (r *realm) offlineUser(loginName, password string) (model.User, bool) {
+	credential := offlineCredential{}
+	if jsonObj, err := redisClient.Get(offlineCacheKey(r.name, loginName)).Result(); err != nil {
+		return model.User{}, false
+	} else if err := json.Unmarshal([]byte(jsonObj), &credential); err != nil {
+		utility.Log.Debug("system cannot unmarshal the offline credential, login: %s", loginName)
+		return model.User{}, false
+	} else if len(credential.Hash) == 0 {
+		return model.User{}, false
+	}
+
+	// the attempt is counted before hashing, so parallel attempts share the limit
+	// LDAP_OFFLINE_LOGIN_MAX_FAILURES
+	failureKey := offlineFailureKey(r.name, loginName)
+	failures, err := redisClient.Incr(failureKey).Result()
+	if err != nil {
+		return model.User{}, false
+	} else if failures == 1 {
+		redisClient.Expire(failureKey, time.Duration(r.intEnv("LDAP_OFFLINE_LOGIN_TTL", 60*60*24))*time.Second)
+	}
+	if failures > int64(r.intEnv("LDAP_OFFLINE_LOGIN_MAX_FAILURES", 5)) {
+		utility.Log.Audit("offline_login_locked", "login: %s", r.qualify(loginName))
+		return model.User{}, false
+	}
+
+	select {
+	case offlineHashSlots <- struct{}{}:
+	default:
+		utility.Log.Debug("Offline login is busy, login: %s", loginName)
+		redisClient.Decr(failureKey)
+		return model.User{}, false
+	}
+	hash := argon2.IDKey([]byte(password), credential.Salt,
+		credential.Time, credential.Memory, credential.Threads, uint32(len(credential.Hash)))
+	<-offlineHashSlots
+
+	if subtle.ConstantTimeCompare(hash, credential.Hash) != 1 {
+		return model.User{}, false
+	}
+	redisClient.Del(failureKey)
+	return credential.User, true
+}
+
+// offlineLogin authenticates with the stored credentials of the realms chosen
+// by selectRealms, when the directory has reported unavailable with cause.
+// The group rules of checkAccess are applied, the access filter needs LDAP.
+func offlineLogin(username, password, realmName string, cause error) (user model.User, error error) {
+	user = model.User{}
+	error = cause
+
+	candidates, username, err := selectRealms(username, realmName)
+	if err != nil {
+		return
+	}
+
+	for _, r := range candidates {
+		if !r.offlineLoginEnabled() {
+			continue
+		}
+		loginName := r.loginName(username)
+		if offline, ok := r.offlineUser(loginName, password); !ok {
+			continue
+		} else if error = r.checkGroups(&offline); error != nil {
+			return
+		} else {
+			utility.Log.Audit("offline_login", "userId: %s", r.qualify(offline.Id))
+			user = offline
+			return
+		}
+	}
+	return
+}
+
+// invalidateOfflineCredentials drops the stored credentials of every login
+// name of the user, e.g. after a password change.
+func (r *realm) invalidateOfflineCredentials(userId string) {
+	loginsKey := offlineLoginsKey(r.qualify(userId))
+	loginNames, err := redisClient.SMembers(loginsKey).Result()
+	if err != nil {
+		utility.Log.Debug("Reading offline logins is failed, userId: %s", r.qualify(userId))
+		return
+	}
+	keys := []string{loginsKey}
+	for _, loginName := range loginNames {
+		keys = append(keys, offlineCacheKey(r.name, loginName), offlineFailureKey(r.name, loginName))
+	}
+	if err := redisClient.Del(keys...).Err(); err != nil {
+		utility.Log.Debug("Invalidating offline credentials is failed, userId: %s", r.qualify(userId))
+	}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/michibiki-io/ldap-jwt-go/model"
+)
+
+// waitForKey waits for the background store of an offline credential.
+func waitForKey(t *testing.T, key string) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if testRedis.Exists(key) {
+			return
+		}
+	}
+	t.Fatalf("%s is not stored", key)
+}
+
+func TestOfflineCredential(t *testing.T) {
+	r := &realm{name: "offlinetest"}
+	t.Setenv("OFFLINETEST_LDAP_OFFLINE_LOGIN", "true")
+
+	r.storeOfflineCredential("alice", "secret", &model.User{Id: "alice", DN: "uid=alice,dc=example,dc=com", Realm: r.name})
+	waitForKey(t, offlineCacheKey(r.name, "alice"))
+
+	if _, ok := r.offlineUser("alice", "wrong"); ok {
+		t.Errorf("a wrong password is accepted offline")
+	}
+	if user, ok := r.offlineUser("alice", "secret"); !ok || user.Id != "alice" {
+		t.Errorf("offlineUser = %v, %v, want alice", user, ok)
+	}
+
+	r.invalidateOfflineCredentials("alice")
+	if _, ok := r.offlineUser("alice", "secret"); ok {
+		t.Errorf("an invalidated password is accepted offline")
+	}
+}
+
+func TestStoreOfflineCredentialBusy(t *testing.T) {
+	r := &realm{name: "offlinetest"}
+	t.Setenv("OFFLINETEST_LDAP_OFFLINE_LOGIN", "true")
+
+	r.storeOfflineCredential("bob", "old", &model.User{Id: "bob", Realm: r.name})
+	waitForKey(t, offlineCacheKey(r.name, "bob"))
+
+	for i := 0; i < cap(offlineStoreSlots); i++ {
+		offlineStoreSlots <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < cap(offlineStoreSlots); i++ {
+			<-offlineStoreSlots
+		}
+	}()
+
+	// the login does not wait, and the credential of the old password is dropped
+	start := time.Now()
+	r.storeOfflineCredential("bob", "new", &model.User{Id: "bob", Realm: r.name})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("storing while busy took %v", elapsed)
+	}
+	if testRedis.Exists(offlineCacheKey(r.name, "bob")) {
+		t.Errorf("the credential of the old password is kept while storing is busy")
+	}
+}
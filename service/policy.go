@@ -0,0 +1,32 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"github.com/michibiki-io/ldap-jwt-go/utility/ldapc"
+)
+
+// passwordPolicyError converts the error of the password policy control.
+func passwordPolicyError(policy ldapc.PasswordPolicy) error {
+	switch policy.Error {
+	case ldapc.PolicyAccountLocked:
+		return utility.NewError(fmt.Sprintf("Account is locked"), utility.AccountLocked)
+	case ldapc.PolicyPasswordExpired:
+		return utility.NewError(fmt.Sprintf("Password is expired"), utility.PasswordExpired)
+	case ldapc.PolicyChangeAfterReset:
+		return utility.NewError(fmt.Sprintf("Password must be changed"), utility.PasswordMustChange)
+	}
+	return nil
+}
+
+// verifiedPolicyError is passwordPolicyError only when the bind has verified
+// the password. A locked account is reported whatever the password is, so a
+// failed bind is a wrong password for the caller. An expired password is
+// checked after the password, so it is told although the bind fails.
+func verifiedPolicyError(policy ldapc.PasswordPolicy, bindError error) error {
+	if bindError != nil && policy.Error != ldapc.PolicyPasswordExpired {
+		return nil
+	}
+	return passwordPolicyError(policy)
+}
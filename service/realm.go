@@ -0,0 +1,480 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"github.com/michibiki-io/ldap-jwt-go/utility/ldapc"
+	"gopkg.in/ldap.v2"
+)
+
+// realm is a directory users log in to.
+// A setting of a realm is read from <NAME>_<KEY> and falls back to <KEY>,
+// so that a single directory is configured without any prefix.
+type realm struct {
+	name       string
+	ldapClient *ldapc.Client
+
+	userBase           ldapc.Base
+	groupBase          ldapc.Base
+	userFilter         ldapc.Filter // finds the user by the username of the login
+	idFilter           ldapc.Filter // finds the user by the user id
+	groupFilter        ldapc.Filter
+	primaryGroupFilter ldapc.Filter // empty unless LDAP_PRIMARY_GROUP is enabled
+	accessFilter       ldapc.Filter // idFilter and LDAP_FILTER_ACCESS, empty without LDAP_FILTER_ACCESS
+
+	accountChecks []accountCheck
+
+	// credentials of the user for the direct bind mode, see as
+	userDn       string
+	userPassword string
+	userPolicy   *ldapc.PasswordPolicy // policy of the first bind of the user, see search
+}
+
+// realms in the order they are tried when the realm is not specified.
+var realms []*realm
+
+var realmNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func init() {
+	// REALMS
+	// Comma separated realm names, empty for a single directory
+	names := []string{}
+	for _, name := range strings.Split(utility.GetEnv("REALMS", ""), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		} else if !realmNamePattern.MatchString(name) {
+			// the name is a prefix of environment variables
+			panic(fmt.Errorf("invalid realm name: %s, only letters, digits and _ are allowed", name))
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = append(names, "")
+	}
+
+	for _, name := range names {
+		r := &realm{name: name}
+		if err := r.checkSecrets(); err != nil {
+			panic(err)
+		}
+		r.ldapClient = r.newLdapClient()
+		if err := r.parseBases(); err != nil {
+			panic(err)
+		}
+		if err := r.parseFilters(); err != nil {
+			panic(err)
+		}
+		if err := r.parseAccountChecks(); err != nil {
+			panic(err)
+		}
+		realms = append(realms, r)
+	}
+}
+
+func (r *realm) key(key string) string {
+	if r.name == "" {
+		return key
+	}
+	return strings.ToUpper(r.name) + "_" + key
+}
+
+func (r *realm) env(key, fallback string) string {
+	return utility.GetEnv(r.key(key), utility.GetEnv(key, fallback))
+}
+
+// realmSecrets are the credentials and key material which a named realm does
+// not take from the variables without the prefix. The realms are separate
+// directories, one must not receive the credentials of another.
+var realmSecrets = []string{"LDAP_BIND_DN", "LDAP_BIND_PASSWORD", "LDAP_CLIENT_CERT_FILE", "LDAP_CLIENT_KEY_FILE"}
+
+// secretEnv is env of realmSecrets, without the fallback to the variable
+// without the prefix.
+func (r *realm) secretEnv(key, fallback string) string {
+	return utility.GetEnv(r.key(key), fallback)
+}
+
+// checkSecrets fails when a realmSecrets variable is set without the prefix
+// but not for the named realm, which would silently use the default instead.
+func (r *realm) checkSecrets() error {
+	if r.name == "" {
+		return nil
+	}
+	for _, key := range realmSecrets {
+		if r.directBind() && (key == "LDAP_BIND_DN" || key == "LDAP_BIND_PASSWORD") {
+			// not used without a service account
+			continue
+		}
+		if utility.GetEnv(key, "") != "" && utility.GetEnv(r.key(key), "") == "" {
+			return fmt.Errorf("%s is not shared by the realms, set %s for realm %s", key, r.key(key), r.name)
+		}
+	}
+	return nil
+}
+
+func (r *realm) intEnv(key string, fallback int) int {
+	return utility.GetIntEnv(r.key(key), utility.GetIntEnv(key, fallback))
+}
+
+func (r *realm) boolEnv(key string, fallback bool) bool {
+	return utility.GetBoolEnv(r.key(key), utility.GetBoolEnv(key, fallback))
+}
+
+// qualify makes a user id unique over the realms.
+func (r *realm) qualify(userId string) string {
+	return qualifiedUserId(r.name, userId)
+}
+
+func qualifiedUserId(realmName, userId string) string {
+	if realmName == "" {
+		return userId
+	}
+	return realmName + "/" + userId
+}
+
+func findRealm(name string) *realm {
+	for _, r := range realms {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// selectRealms returns the realms to try for the username, and the
+// username without the realm suffix. The realm is chosen by realmName,
+// by REALM_SUFFIX of the realm, or all realms are tried in order.
+func selectRealms(username, realmName string) ([]*realm, string, error) {
+	if realmName != "" {
+		if r := findRealm(realmName); r != nil {
+			return []*realm{r}, username, nil
+		}
+		return nil, username, utility.NewError(fmt.Sprintf("Realm is not found: %s", realmName), utility.Unauthorized)
+	}
+
+	for _, r := range realms {
+		// REALM_SUFFIX
+		// e.g. @partner.example.com, removed from the username
+		if suffix := utility.GetEnv(r.key("REALM_SUFFIX"), ""); suffix != "" && strings.HasSuffix(username, suffix) {
+			return []*realm{r}, strings.TrimSuffix(username, suffix), nil
+		}
+	}
+
+	return realms, username, nil
+}
+
+// LDAP_BIND_MODE
+// SERVICE searches with LDAP_BIND_DN, DIRECT searches as the user
+// bound with LDAP_USER_DN_TEMPLATE and needs no service account.
+func (r *realm) directBind() bool {
+	return r.env("LDAP_BIND_MODE", "SERVICE") == "DIRECT"
+}
+
+// as returns a copy of the realm which searches as the user in the
+// direct bind mode, the realm itself otherwise.
+func (r *realm) as(username, password string) *realm {
+	if !r.directBind() {
+		return r
+	}
+	bound := *r
+	// LDAP_USER_DN_TEMPLATE
+	// %s is replaced by the username, e.g. uid=%s,ou=people,dc=example,dc=com or %s@example.com
+	bound.userDn = ldapc.BindDN(r.env("LDAP_USER_DN_TEMPLATE", "uid=%s,"+r.ldapClient.Bind.BaseDN), username)
+	bound.userPassword = password
+	return &bound
+}
+
+// bindWithPolicy binds as dn with the password policy control. In the direct
+// bind mode the first search has verified the password already, its policy
+// is returned instead of binding again, which would take another grace login.
+func (r *realm) bindWithPolicy(ctx context.Context, dn, password string) (ldapc.PasswordPolicy, error) {
+	if r.userPolicy != nil {
+		return *r.userPolicy, nil
+	}
+	return r.ldapClient.DoBindWithPolicy(ctx, dn, password)
+}
+
+// canSearch is false in the direct bind mode without the credentials of
+// the user, the user captured at login is used instead.
+func (r *realm) canSearch() bool {
+	return !r.directBind() || r.userDn != ""
+}
+
+// search searches as the user in the direct bind mode. Its first search binds
+// with the password policy control, so an expired password or one which must
+// be changed is told instead of a failed bind or search.
+func (r *realm) search(ctx context.Context, base ldapc.Base, filter string, attributes ...string) ([]*ldap.Entry, error) {
+	if r.userDn != "" && r.userPolicy == nil {
+		entries, policy, err := r.ldapClient.SearchAsWithPolicy(ctx, r.userDn, r.userPassword, base, filter, attributes...)
+		if policyError := verifiedPolicyError(policy, err); policyError != nil {
+			return nil, policyError
+		} else if err == nil {
+			r.userPolicy = &policy
+		}
+		return entries, err
+	} else if r.userDn != "" {
+		return r.ldapClient.SearchAs(ctx, r.userDn, r.userPassword, base, filter, attributes...)
+	} else if !r.canSearch() {
+		return nil, utility.NewError(fmt.Sprintf("LDAP Search requires the credentials of the user in the direct bind mode"), utility.InternalServerError)
+	}
+	return r.ldapClient.Search(ctx, base, filter, attributes...)
+}
+
+// lookupUser finds the user in the realms chosen by selectRealms.
+// A realm which does not know the user falls through to the next one.
+// The returned realm searches as the user in the direct bind mode, the
+// account status of the returned entry is not checked yet.
+func lookupUser(ctx context.Context, username, password, realmName string) (r *realm, user model.User, entry *ldap.Entry, error error) {
+	user = model.User{}
+	entry = nil
+	error = nil
+
+	candidates, username, err := selectRealms(username, realmName)
+	if err != nil {
+		error = err
+		return
+	}
+
+	error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed: user is not found"), utility.Unauthorized)
+	for _, candidate := range candidates {
+		name := candidate.loginName(username)
+		r = candidate.as(name, password)
+		if user, entry, err = r.loginUser(ctx, name); err == nil {
+			error = nil
+			return
+		} else if e, ok := err.(*utility.Error); !ok || e.No() != utility.Unauthorized {
+			// remember the failure, but still try the other realms
+			utility.Log.Debug("Searching user in realm %s is failed: %v", r.name, err)
+			error = err
+		}
+	}
+	r = nil
+	return
+}
+
+// loginName normalizes the username of a login for the realm.
+func (r *realm) loginName(username string) string {
+	if r.isActiveDirectory() {
+		return r.normalizeAdUsername(username)
+	}
+	return username
+}
+
+// parseBases reads the search bases of users and groups,
+// LDAP_BASE_DN is used when they are not set.
+func (r *realm) parseBases() (err error) {
+	// LDAP_USER_BASE_DN, LDAP_USER_SCOPE
+	r.userBase.DN = r.env("LDAP_USER_BASE_DN", "")
+	if r.userBase.Scope, err = ldapc.ParseScope(r.env("LDAP_USER_SCOPE", "sub")); err != nil {
+		return
+	}
+	// LDAP_GROUP_BASE_DN, LDAP_GROUP_SCOPE
+	r.groupBase.DN = r.env("LDAP_GROUP_BASE_DN", "")
+	if r.groupBase.Scope, err = ldapc.ParseScope(r.env("LDAP_GROUP_SCOPE", "sub")); err != nil {
+		return
+	}
+	return nil
+}
+
+// parseFilters validates the filter templates of the realm.
+// %s of former templates is still accepted for {username} and {member}.
+func (r *realm) parseFilters() (err error) {
+	if r.userFilter, err = ldapc.ParseFilter(r.userFilterTemplate(), ldapc.PlaceholderUsername,
+		ldapc.PlaceholderUsername); err != nil {
+		return
+	}
+	if r.idFilter, err = ldapc.ParseFilter(r.idFilterTemplate(), "", ldapc.PlaceholderUsername); err != nil {
+		return
+	}
+	if r.groupFilter, err = ldapc.ParseFilter(r.groupFilterTemplate(), ldapc.PlaceholderMember,
+		ldapc.PlaceholderDN, ldapc.PlaceholderMember, ldapc.PlaceholderUsername,
+		ldapc.PlaceholderUid, ldapc.PlaceholderUidNumber, ldapc.PlaceholderGidNumber); err != nil {
+		return
+	}
+	if r.primaryGroupEnabled() {
+		// LDAP_FILTER_PRIMARY_GROUP
+		if r.primaryGroupFilter, err = ldapc.ParseFilter(r.env("LDAP_FILTER_PRIMARY_GROUP", "(&(objectClass=posixGroup)(gidNumber={gidNumber}))"), "",
+			ldapc.PlaceholderDN, ldapc.PlaceholderMember, ldapc.PlaceholderUsername,
+			ldapc.PlaceholderUid, ldapc.PlaceholderUidNumber, ldapc.PlaceholderGidNumber); err != nil {
+			return
+		}
+	}
+	// LDAP_FILTER_ACCESS
+	// Filter the user entry must match in addition to LDAP_FILTER_USER
+	if access := r.env("LDAP_FILTER_ACCESS", ""); access != "" {
+		if r.accessFilter, err = ldapc.ParseFilter("(&"+r.idFilter.String()+access+")", "",
+			ldapc.PlaceholderUsername); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// claimAttributes returns LDAP_CLAIMS as claim name to attribute.
+func (r *realm) claimAttributes() map[string]string {
+	// LDAP_CLAIMS
+	// Comma separated claim=attribute, e.g. email=mail,name=displayName
+	claims := map[string]string{}
+	for _, pair := range strings.Split(r.env("LDAP_CLAIMS", ""), ",") {
+		if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+			claims[kv[0]] = kv[1]
+		}
+	}
+	return claims
+}
+
+func (r *realm) newLdapClient() *ldapc.Client {
+
+	// LDAP_PROTOCOL
+	protocol := ldapc.LDAP
+	switch r.env("LDAP_PROTOCOL", "LDAP") {
+	case "LDAPS":
+		protocol = ldapc.LDAPS
+	case "START_TLS":
+		protocol = ldapc.START_TLS
+	default:
+		protocol = ldapc.LDAP
+	}
+
+	// LDAP_HOST
+	ldapHost := r.env("LDAP_HOST", "localhost")
+
+	// LDAP_PORT
+	ldapPort := r.intEnv("LDAP_PORT", 389)
+
+	// LDAP_URLS
+	// Comma separated ldap:// or ldaps:// URLs, used instead of LDAP_HOST and LDAP_PORT
+	servers := []ldapc.Server{}
+	for _, rawURL := range strings.Split(r.env("LDAP_URLS", ""), ",") {
+		if strings.TrimSpace(rawURL) == "" {
+			continue
+		}
+		if server, err := ldapc.ParseURL(rawURL, protocol == ldapc.START_TLS); err != nil {
+			panic(err)
+		} else {
+			servers = append(servers, server)
+		}
+	}
+
+	// LDAP_BALANCE
+	balance := ldapc.Priority
+	switch r.env("LDAP_BALANCE", "PRIORITY") {
+	case "ROUND_ROBIN":
+		balance = ldapc.RoundRobin
+	default:
+		balance = ldapc.Priority
+	}
+
+	// LDAP_COOLDOWN
+	// Seconds to skip a failed LDAP server
+	coolDown := time.Duration(r.intEnv("LDAP_COOLDOWN", 30)) * time.Second
+
+	// LDAP_SKIPVERIFY
+	// Skip verification of server certificate
+	skipVerify := r.boolEnv("LDAP_SKIPVERIFY", false)
+
+	// LDAP_TLS_PINS
+	// Comma separated base64 SHA-256 of the SubjectPublicKeyInfo of accepted certificates
+	pins := []string{}
+	for _, pin := range strings.Split(r.env("LDAP_TLS_PINS", ""), ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+
+	tlsConfig, err := ldapc.NewTLSConfig(ldapc.TLSOptions{
+		SkipVerify: skipVerify,
+		// LDAP_CA_FILE
+		CAFile: r.env("LDAP_CA_FILE", ""),
+		// LDAP_TLS_SERVER_NAME
+		ServerName: r.env("LDAP_TLS_SERVER_NAME", ""),
+		// LDAP_TLS_MIN_VERSION
+		MinVersion: r.env("LDAP_TLS_MIN_VERSION", "1.2"),
+		// LDAP_CLIENT_CERT_FILE, LDAP_CLIENT_KEY_FILE
+		CertFile: r.secretEnv("LDAP_CLIENT_CERT_FILE", ""),
+		KeyFile:  r.secretEnv("LDAP_CLIENT_KEY_FILE", ""),
+		Pins:     pins,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// LDAP_BIND_DN
+	bindDn := r.secretEnv("LDAP_BIND_DN", "cn=readonly,dc=example,dc=com")
+
+	// LDAP_BIND_PASSWORD
+	bindPassword := r.secretEnv("LDAP_BIND_PASSWORD", "readonly")
+
+	// LDAP_BASE_DN
+	baseDn := r.env("LDAP_BASE_DN", "dc=example,dc=com")
+
+	// LDAP_POOL_SIZE
+	// Maximum pooled connections for searches and for user binds (0: no pooling)
+	poolSize := r.intEnv("LDAP_POOL_SIZE", 5)
+
+	// LDAP_DIAL_TIMEOUT
+	// Seconds to connect to a LDAP server (0: no limit)
+	dialTimeout := time.Duration(r.intEnv("LDAP_DIAL_TIMEOUT", 5)) * time.Second
+
+	// LDAP_TIMEOUT
+	// Seconds of a LDAP operation including failover (0: no limit)
+	timeout := time.Duration(r.intEnv("LDAP_TIMEOUT", 10)) * time.Second
+
+	// LDAP_BREAKER_THRESHOLD
+	// Consecutive failures which make requests fail fast (0: disabled)
+	breakerThreshold := r.intEnv("LDAP_BREAKER_THRESHOLD", 5)
+
+	// LDAP_BREAKER_COOLDOWN
+	// Seconds requests fail fast after LDAP_BREAKER_THRESHOLD failures
+	breakerCoolDown := time.Duration(r.intEnv("LDAP_BREAKER_COOLDOWN", 30)) * time.Second
+
+	// LDAP_REFERRAL_HOSTS
+	// Comma separated hosts referrals may point to, *.example.com matches subdomains
+	referralHosts := []string{}
+	for _, host := range strings.Split(r.env("LDAP_REFERRAL_HOSTS", ""), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			referralHosts = append(referralHosts, host)
+		}
+	}
+
+	// LDAP_POOL_IDLE_TIMEOUT
+	// Seconds to keep idle pooled connections (0: no limit)
+	idleTimeout := time.Duration(r.intEnv("LDAP_POOL_IDLE_TIMEOUT", 300)) * time.Second
+
+	return &ldapc.Client{
+		Protocol:  protocol,
+		Host:      ldapHost,
+		Port:      ldapPort,
+		Servers:   servers,
+		Balance:   balance,
+		CoolDown:  coolDown,
+		TLSConfig: tlsConfig,
+		Bind: ldapc.Bind{
+			BindDN:       bindDn,
+			BindPassword: bindPassword,
+			BaseDN:       baseDn,
+		},
+		PoolSize:    poolSize,
+		IdleTimeout: idleTimeout,
+		PageSize:    uint32(r.intEnv("LDAP_PAGE_SIZE", 500)),
+		SizeLimit:   r.intEnv("LDAP_SIZE_LIMIT", 0),
+		TimeLimit:   r.intEnv("LDAP_TIME_LIMIT", 0),
+
+		DialTimeout:      dialTimeout,
+		Timeout:          timeout,
+		BreakerThreshold: breakerThreshold,
+		BreakerCoolDown:  breakerCoolDown,
+		Referrals: ldapc.Referrals{
+			// LDAP_REFERRALS
+			Follow: r.boolEnv("LDAP_REFERRALS", false),
+			// LDAP_REFERRAL_HOPS
+			HopLimit:     r.intEnv("LDAP_REFERRAL_HOPS", 3),
+			TrustedHosts: referralHosts,
+		},
+	}
+}
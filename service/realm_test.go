@@ -0,0 +1,76 @@
+package service
+
+import "testing"
+
+func TestSecretEnv(t *testing.T) {
+	t.Setenv("LDAP_BIND_PASSWORD", "corp-secret")
+	t.Setenv("LDAP_HOST", "ldap.corp.example.com")
+
+	unnamed := &realm{}
+	if got := unnamed.secretEnv("LDAP_BIND_PASSWORD", "readonly"); got != "corp-secret" {
+		t.Errorf("secretEnv of the unnamed realm = %q, want corp-secret", got)
+	}
+
+	partner := &realm{name: "partner"}
+	if got := partner.secretEnv("LDAP_BIND_PASSWORD", "readonly"); got != "readonly" {
+		t.Errorf("secretEnv of a named realm = %q, want the default", got)
+	}
+	if got := partner.env("LDAP_HOST", "localhost"); got != "ldap.corp.example.com" {
+		t.Errorf("env of a named realm = %q, want the shared value", got)
+	}
+	t.Setenv("PARTNER_LDAP_BIND_PASSWORD", "partner-secret")
+	if got := partner.secretEnv("LDAP_BIND_PASSWORD", "readonly"); got != "partner-secret" {
+		t.Errorf("secretEnv of a named realm = %q, want partner-secret", got)
+	}
+}
+
+func TestCheckSecrets(t *testing.T) {
+	partner := &realm{name: "partner"}
+	if err := partner.checkSecrets(); err != nil {
+		t.Errorf("checkSecrets without shared secrets = %v", err)
+	}
+
+	t.Setenv("LDAP_CLIENT_KEY_FILE", "/private/corp.key")
+	if err := partner.checkSecrets(); err == nil {
+		t.Errorf("a shared client key is accepted for a named realm")
+	}
+	if err := (&realm{}).checkSecrets(); err != nil {
+		t.Errorf("checkSecrets of the unnamed realm = %v", err)
+	}
+	t.Setenv("PARTNER_LDAP_CLIENT_KEY_FILE", "/private/partner.key")
+	if err := partner.checkSecrets(); err != nil {
+		t.Errorf("checkSecrets with the secrets of the realm = %v", err)
+	}
+
+	t.Setenv("LDAP_BIND_DN", "cn=service,dc=corp,dc=example,dc=com")
+	if err := partner.checkSecrets(); err == nil {
+		t.Errorf("a shared bind DN is accepted for a named realm")
+	}
+	t.Setenv("PARTNER_LDAP_BIND_MODE", "DIRECT")
+	if err := partner.checkSecrets(); err != nil {
+		t.Errorf("checkSecrets of a realm without a service account = %v", err)
+	}
+}
+
+func TestIdAttribute(t *testing.T) {
+	r := &realm{name: "idtest"}
+	if got := r.idAttribute(); got != "" || r.idRequired() {
+		t.Errorf("idAttribute without login attributes = %q, want the username", got)
+	}
+
+	t.Setenv("IDTEST_LDAP_LOGIN_ATTRIBUTES", "uid,mail")
+	if got := r.idAttribute(); got != "uid" || !r.idRequired() {
+		t.Errorf("idAttribute with login attributes = %q, want uid", got)
+	}
+	t.Setenv("IDTEST_LDAP_ID_ATTRIBUTE", "employeeNumber")
+	if got := r.idAttribute(); got != "employeeNumber" {
+		t.Errorf("idAttribute = %q, want employeeNumber", got)
+	}
+
+	ad := &realm{name: "adidtest"}
+	t.Setenv("ADIDTEST_LDAP_SERVER_TYPE", "AD")
+	t.Setenv("ADIDTEST_LDAP_LOGIN_ATTRIBUTES", "sAMAccountName,userPrincipalName")
+	if got := ad.idAttribute(); got != "sAMAccountName" {
+		t.Errorf("idAttribute of AD = %q, want sAMAccountName", got)
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+)
+
+func revocationChannel() string {
+	// REVOCATION_CHANNEL
+	// Redis pub/sub channel for revocation events
+	return utility.GetEnv("REVOCATION_CHANNEL", "ldap-jwt:revocations")
+}
+
+// publishRevocation notifies subscribers that the tokens are revoked.
+func publishRevocation(reason string, uuids ...string) {
+	revocation := model.Revocation{Reason: reason, RevokedAt: time.Now().Unix()}
+	for _, uuid := range uuids {
+		if uuid != "" {
+			revocation.Uuids = append(revocation.Uuids, uuid)
+		}
+	}
+	if len(revocation.Uuids) == 0 {
+		return
+	}
+
+	if jsonObj, err := json.Marshal(revocation); err != nil {
+		utility.Log.Debug("system cannot marshal the revocation: %v", err)
+	} else if err := redisClient.Publish(revocationChannel(), jsonObj).Err(); err != nil {
+		utility.Log.Debug("Publishing revocation is failed: %v", err)
+	}
+}
+
+type RevocationService struct{}
+
+// subscribers is the number of the current subscriptions of this instance.
+var subscribers int32
+
+// Subscribe returns revocation events published by every instance.
+// The returned function must be called to stop the subscription.
+// ok is false when REVOCATION_MAX_SUBSCRIBERS are already subscribed.
+func (*RevocationService) Subscribe() (events <-chan model.Revocation, unsubscribe func(), ok bool) {
+	// REVOCATION_MAX_SUBSCRIBERS
+	// Maximum concurrent subscribers of /v1/revocations of an instance
+	if atomic.AddInt32(&subscribers, 1) > int32(utility.GetIntEnv("REVOCATION_MAX_SUBSCRIBERS", 100)) {
+		atomic.AddInt32(&subscribers, -1)
+		return nil, nil, false
+	}
+	stream, stop := subscribe()
+	return stream, func() {
+		stop()
+		atomic.AddInt32(&subscribers, -1)
+	}, true
+}
+
+func subscribe() (<-chan model.Revocation, func()) {
+	pubsub := redisClient.Subscribe(revocationChannel())
+	events := make(chan model.Revocation)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(events)
+		for message := range pubsub.Channel() {
+			revocation := model.Revocation{}
+			if err := json.Unmarshal([]byte(message.Payload), &revocation); err != nil {
+				utility.Log.Debug("system cannot unmarshal the revocation: %v", err)
+				continue
+			}
+			select {
+			case events <- revocation:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return events, func() {
+		close(done)
+		pubsub.Close()
+	}
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+)
+
+// consumeScript atomically takes a stored auth out of redis together with
+// its linked token. A refresh token consumed for rotation keeps the family,
+// which storeScript points to the new pair, otherwise the family ends. The
+// keys are derived from the stored auth read beforehand, a stored auth is
+// never modified, only deleted.
+//
+// KEYS[1]: token uuid
+// KEYS[2]: linked token uuid
+// KEYS[3]: family key
+// KEYS[4]: sessions key of the user
+// ARGV[1]: expected store type
+// ARGV[2]: 1 to keep the family for the pair which replaces the token
+var consumeScript = redis.NewScript(`
+local stored = redis.call('GET', KEYS[1])
+if not stored then
+	return false
+end
+local auth = cjson.decode(stored)
+if auth.Type ~= tonumber(ARGV[1]) or (auth.LinkedUuid or '') ~= KEYS[2] then
+	return false
+end
+redis.call('DEL', KEYS[1])
+if KEYS[2] ~= '' then
+	redis.call('DEL', KEYS[2])
+end
+if auth.FamilyId and auth.FamilyId ~= '' and ARGV[2] ~= '1' then
+	redis.call('DEL', KEYS[3])
+	redis.call('SREM', KEYS[4], auth.FamilyId)
+end
+return stored
+`)
+
+// revokeFamilyScript atomically deletes the current token pair of a family
+// and returns the deleted family record. The token uuids are read from the
+// family beforehand, nothing is deleted when the family has been rotated since.
+//
+// KEYS[1]: family key
+// KEYS[2]: access token uuid
+// KEYS[3]: refresh token uuid
+var revokeFamilyScript = redis.NewScript(`
+local stored = redis.call('GET', KEYS[1])
+if not stored then
+	return false
+end
+local family = cjson.decode(stored)
+if family.AccessUuid ~= KEYS[2] or family.RefreshUuid ~= KEYS[3] then
+	return false
+end
+redis.call('DEL', KEYS[2], KEYS[3], KEYS[1])
+return stored
+`)
+
+// readAuth returns the stored auth of the token without consuming it.
+func readAuth(token *model.Token, storeType model.StoreType) (storedAuth model.StoredAuth, error error) {
+	storedAuth = model.StoredAuth{}
+	error = nil
+
+	if jsonObj, err := redisClient.Get(token.Uuid).Result(); err != nil {
+		error = utility.NewError(fmt.Sprintf("Token is invalid"), utility.Unauthorized)
+		utility.Log.Debug("Stored Token is not found, UUID: %s", token.Uuid)
+	} else if err := json.Unmarshal([]byte(jsonObj), &storedAuth); err != nil {
+		error = utility.NewError(fmt.Sprintf("Token is invalid"), utility.UnprocessableEntity)
+		utility.Log.Debug("system cannot unmarshal the stored token, UUID: %s", token.Uuid)
+	} else if storedAuth.Type != storeType {
+		error = utility.NewError(fmt.Sprintf("Token is invalid"), utility.Unauthorized)
+		utility.Log.Debug("Stored Token Type is different, UUID: %s", token.Uuid)
+	}
+	return
+}
+
+// consumeAuth removes the stored auth of the token and its linked token in
+// one step, so only one of concurrent callers can obtain it. A refresh token
+// consumed for RevokeReasonRotation keeps its family, storeAuth replaces the
+// pair and marks the token as rotated.
+func consumeAuth(token *model.Token, storeType model.StoreType, reason string) (storedAuth model.StoredAuth, error error) {
+	storedAuth = model.StoredAuth{}
+	error = nil
+
+	keepFamily := ""
+	if storeType == model.StoreTypeRefresh && reason == model.RevokeReasonRotation {
+		keepFamily = "1"
+	}
+
+	if stored, err := readAuth(token, storeType); err != nil {
+		error = err
+	} else if jsonObj, err := consumeScript.Run(redisClient, []string{token.Uuid, stored.LinkedUuid,
+		familyKey(stored.FamilyId), userSessionsKey(qualifiedUserId(stored.Realm, stored.UserId))},
+		int(storeType), keepFamily).Text(); err == redis.Nil {
+		error = utility.NewError(fmt.Sprintf("Token is invalid"), utility.Unauthorized)
+		utility.Log.Debug("Stored Token is not found, UUID: %s", token.Uuid)
+	} else if err != nil {
+		error = err
+	} else if err := json.Unmarshal([]byte(jsonObj), &storedAuth); err != nil {
+		error = utility.NewError(fmt.Sprintf("Token is invalid"), utility.UnprocessableEntity)
+		utility.Log.Debug("system cannot unmarshal the stored token, UUID: %s", token.Uuid)
+	} else {
+		publishRevocation(reason, token.Uuid, storedAuth.LinkedUuid)
+	}
+	return
+}
+
+// storeScript saves a token pair, the family record and the session of the
+// user. A pair which replaces a consumed one is saved only while the family
+// still points to the consumed pair, so a family revoked meanwhile is not
+// brought back by a refresh which is running at the same time. The consumed
+// refresh token is marked as rotated only together with the new pair, so a
+// retry after a failed store is not taken for a reuse.
+//
+// KEYS[1]: access token uuid
+// KEYS[2]: refresh token uuid
+// KEYS[3]: family key
+// KEYS[4]: sessions key of the user
+// KEYS[5]: rotated key of the consumed refresh token, only when it is replaced
+// ARGV[1]: stored access auth
+// ARGV[2]: stored refresh auth
+// ARGV[3]: family record
+// ARGV[4]: family id
+// ARGV[5]: milliseconds to keep the access token
+// ARGV[6]: milliseconds to keep the refresh token and the family
+// ARGV[7]: consumed access token uuid, empty when nothing is replaced
+// ARGV[8]: consumed refresh token uuid, empty when nothing is replaced
+// ARGV[9]: rotated mark of the consumed refresh token
+// ARGV[10]: seconds to keep the rotated mark
+var storeScript = redis.NewScript(`
+if ARGV[8] ~= '' then
+	local stored = redis.call('GET', KEYS[3])
+	if not stored then
+		return false
+	end
+	local family = cjson.decode(stored)
+	if family.AccessUuid ~= ARGV[7] or family.RefreshUuid ~= ARGV[8] then
+		return false
+	end
+	if tonumber(ARGV[10]) > 0 then
+		redis.call('SET', KEYS[5], ARGV[9], 'EX', ARGV[10])
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[5])
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[6])
+redis.call('SET', KEYS[3], ARGV[3], 'PX', ARGV[6])
+redis.call('SADD', KEYS[4], ARGV[4])
+redis.call('PEXPIRE', KEYS[4], ARGV[6])
+return 1
+`)
+
+// rotation is the token pair consumed by a refresh, which the new pair replaces.
+type rotation struct {
+	accessUuid   string
+	refreshToken *model.Token
+}
+
+// storeAuth saves both tokens and the family record in one step. With
+// replaced, it fails as Unauthorized when the family has been revoked
+// since the replaced pair was consumed.
+func storeAuth(user *model.User, session model.Session, tokenSet *model.TokenSet, replaced *rotation) error {
+	now := time.Now()
+	at := time.Unix(tokenSet.AccessToken.Expires, 0).Sub(now)
+	rt := time.Unix(tokenSet.RefreshToken.Expires, 0).Sub(now)
+
+	accessAuth, err := json.Marshal(model.StoredAuth{UserId: user.Id, Realm: user.Realm, Type: model.StoreTypeAccess, LinkedUuid: tokenSet.RefreshToken.Uuid, IssuedAt: now.Unix(), Session: session})
+	if err != nil {
+		return err
+	}
+	refreshAuth, err := json.Marshal(model.StoredAuth{UserId: user.Id, Realm: user.Realm, Type: model.StoreTypeRefresh, LinkedUuid: tokenSet.AccessToken.Uuid, IssuedAt: now.Unix(), Session: session})
+	if err != nil {
+		return err
+	}
+	family, err := json.Marshal(model.TokenFamily{UserId: user.Id, Realm: user.Realm, AccessUuid: tokenSet.AccessToken.Uuid, RefreshUuid: tokenSet.RefreshToken.Uuid})
+	if err != nil {
+		return err
+	}
+
+	keys := []string{tokenSet.AccessToken.Uuid, tokenSet.RefreshToken.Uuid,
+		familyKey(session.FamilyId), userSessionsKey(qualifiedUserId(user.Realm, user.Id))}
+	consumedAccess, consumedRefresh, rotatedFor := "", "", int64(0)
+	rotated := []byte{}
+	if replaced != nil {
+		keys = append(keys, rotatedKey(replaced.refreshToken.Uuid))
+		consumedAccess, consumedRefresh = replaced.accessUuid, replaced.refreshToken.Uuid
+		rotatedFor = int64(time.Until(time.Unix(replaced.refreshToken.Expires, 0)).Seconds())
+		if rotated, err = json.Marshal(model.RotatedToken{FamilyId: session.FamilyId, RotatedAt: now.Unix()}); err != nil {
+			return err
+		}
+	}
+	if err := storeScript.Run(redisClient, keys,
+		accessAuth, refreshAuth, family, session.FamilyId, at.Milliseconds(), rt.Milliseconds(),
+		consumedAccess, consumedRefresh, rotated, rotatedFor).Err(); err == redis.Nil {
+		utility.Log.Debug("Token family is revoked during the refresh, family: %s", session.FamilyId)
+		return utility.NewError(fmt.Sprintf("Token is invalid"), utility.Unauthorized)
+	} else if err != nil {
+		return err
+	}
+
+	if r := findRealm(user.Realm); r != nil && r.syncEnabled() {
+		_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(syncUsersKey(r.name), strings.ToLower(user.DN), user.Id)
+			pipe.Expire(syncUsersKey(r.name), rt)
+			for _, group := range user.Groups {
+				pipe.SAdd(syncGroupKey(r.name, group), strings.ToLower(user.DN))
+				pipe.Expire(syncGroupKey(r.name, group), rt)
+			}
+			return nil
+		})
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+)
+
+// testRedis is started while the package variables are initialized,
+// which is before init() of user.go connects to REDIS_HOST.
+var testRedis = startTestRedis()
+
+func startTestRedis() *miniredis.Miniredis {
+	server, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("REDIS_HOST", server.Addr())
+	return server
+}
+
+// storeTestAuth stores a token pair of a new family and returns it.
+func storeTestAuth(t *testing.T, name string) (model.Session, model.TokenSet) {
+	t.Helper()
+	expires := time.Now().Add(time.Hour).Unix()
+	session := model.Session{FamilyId: name + "-family", AuthTime: time.Now().Unix()}
+	tokenSet := model.TokenSet{
+		AccessToken:  model.Token{Uuid: name + "-access", Expires: expires},
+		RefreshToken: model.Token{Uuid: name + "-refresh", Expires: expires},
+	}
+	if err := storeAuth(&model.User{Id: "alice"}, session, &tokenSet, nil); err != nil {
+		t.Fatal(err)
+	}
+	return session, tokenSet
+}
+
+func TestConsumeAuthConcurrentRefresh(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		session, tokenSet := storeTestAuth(t, fmt.Sprintf("concurrent%d", i))
+
+		start := make(chan struct{})
+		errs := make(chan error, 2)
+		wg := sync.WaitGroup{}
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				<-start
+				_, err := consumeAuth(&tokenSet.RefreshToken, model.StoreTypeRefresh, model.RevokeReasonRotation)
+				if err == nil {
+					_, err = rotateTestAuth(session, tokenSet, fmt.Sprintf("concurrent%d-%d", i, j))
+				}
+				errs <- err
+			}(j)
+		}
+		close(start)
+		wg.Wait()
+		close(errs)
+
+		won, lost := 0, 0
+		for err := range errs {
+			if err == nil {
+				won++
+			} else if e, ok := err.(*utility.Error); ok && e.No() == utility.Unauthorized {
+				lost++
+			} else {
+				t.Fatalf("consumeAuth failed: %v", err)
+			}
+		}
+		if won != 1 || lost != 1 {
+			t.Fatalf("%d refreshes won and %d lost, want exactly one of each", won, lost)
+		}
+		if testRedis.Exists(tokenSet.AccessToken.Uuid) || testRedis.Exists(tokenSet.RefreshToken.Uuid) {
+			t.Fatalf("the consumed token pair is still stored")
+		}
+		if !testRedis.Exists(rotatedKey(tokenSet.RefreshToken.Uuid)) {
+			t.Fatalf("the rotated refresh token is not marked")
+		}
+	}
+}
+
+func TestConsumeAuthWithoutStore(t *testing.T) {
+	_, tokenSet := storeTestAuth(t, "nostore")
+
+	// storing the new pair fails, e.g. Redis is unavailable
+	if _, err := consumeAuth(&tokenSet.RefreshToken, model.StoreTypeRefresh, model.RevokeReasonRotation); err != nil {
+		t.Fatal(err)
+	}
+	if testRedis.Exists(rotatedKey(tokenSet.RefreshToken.Uuid)) {
+		t.Fatalf("the refresh token is marked as rotated before the new pair is stored")
+	}
+	if reused, _ := detectReuse(&tokenSet.RefreshToken); reused {
+		t.Errorf("a retry of the refresh is taken for a reuse")
+	}
+}
+
+func TestConsumeAuthLogout(t *testing.T) {
+	session, tokenSet := storeTestAuth(t, "logout")
+
+	if _, err := consumeAuth(&tokenSet.AccessToken, model.StoreTypeAccess, model.RevokeReasonLogout); err != nil {
+		t.Fatal(err)
+	}
+	if testRedis.Exists(tokenSet.RefreshToken.Uuid) {
+		t.Errorf("the linked refresh token is still stored")
+	}
+	if testRedis.Exists(rotatedKey(tokenSet.AccessToken.Uuid)) || testRedis.Exists(rotatedKey(tokenSet.RefreshToken.Uuid)) {
+		t.Errorf("a logged out token is marked as rotated")
+	}
+	if testRedis.Exists(familyKey(session.FamilyId)) {
+		t.Errorf("the family of a logged out session is still stored")
+	}
+	if members, _ := testRedis.Members(userSessionsKey("alice")); contains(members, session.FamilyId) {
+		t.Errorf("the logged out session is still a session of the user")
+	}
+}
+
+func TestConsumeAuthWrongType(t *testing.T) {
+	_, tokenSet := storeTestAuth(t, "wrongtype")
+
+	if _, err := consumeAuth(&tokenSet.AccessToken, model.StoreTypeRefresh, model.RevokeReasonRotation); err == nil {
+		t.Fatal("an access token is consumed as a refresh token")
+	}
+	if !testRedis.Exists(tokenSet.AccessToken.Uuid) || !testRedis.Exists(tokenSet.RefreshToken.Uuid) {
+		t.Errorf("the token pair is deleted by a failed consume")
+	}
+}
+
+func TestRevokeFamily(t *testing.T) {
+	session, tokenSet := storeTestAuth(t, "revoke")
+
+	if err := revokeFamily(session.FamilyId, model.RevokeReasonLogout); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{tokenSet.AccessToken.Uuid, tokenSet.RefreshToken.Uuid, familyKey(session.FamilyId)} {
+		if testRedis.Exists(key) {
+			t.Errorf("%s is still stored after the family is revoked", key)
+		}
+	}
+}
+
+// rotateTestAuth stores the pair which replaces the consumed tokenSet.
+func rotateTestAuth(session model.Session, consumed model.TokenSet, name string) (model.TokenSet, error) {
+	expires := time.Now().Add(time.Hour).Unix()
+	tokenSet := model.TokenSet{
+		AccessToken:  model.Token{Uuid: name + "-access", Expires: expires},
+		RefreshToken: model.Token{Uuid: name + "-refresh", Expires: expires},
+	}
+	return tokenSet, storeAuth(&model.User{Id: "alice"}, session, &tokenSet, &rotation{accessUuid: consumed.AccessToken.Uuid, refreshToken: &consumed.RefreshToken})
+}
+
+func TestStoreAuthRotation(t *testing.T) {
+	session, consumed := storeTestAuth(t, "rotation")
+
+	if _, err := consumeAuth(&consumed.RefreshToken, model.StoreTypeRefresh, model.RevokeReasonRotation); err != nil {
+		t.Fatal(err)
+	}
+	tokenSet, err := rotateTestAuth(session, consumed, "rotation2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testRedis.Exists(tokenSet.AccessToken.Uuid) || !testRedis.Exists(tokenSet.RefreshToken.Uuid) {
+		t.Fatalf("the new token pair is not stored")
+	}
+
+	// the family points to the new pair, so the revocation deletes it
+	if err := revokeFamily(session.FamilyId, model.RevokeReasonReuse); err != nil {
+		t.Fatal(err)
+	}
+	if testRedis.Exists(tokenSet.AccessToken.Uuid) || testRedis.Exists(tokenSet.RefreshToken.Uuid) {
+		t.Errorf("the new token pair is still stored after the family is revoked")
+	}
+}
+
+func TestStoreAuthRevokedDuringRotation(t *testing.T) {
+	session, consumed := storeTestAuth(t, "interleaved")
+
+	// the refresh consumes the token, and the family is revoked, e.g. by
+	// reuse detection or a password change, before the new pair is stored
+	if _, err := consumeAuth(&consumed.RefreshToken, model.StoreTypeRefresh, model.RevokeReasonRotation); err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeFamily(session.FamilyId, model.RevokeReasonReuse); err != nil {
+		t.Fatal(err)
+	}
+	tokenSet, err := rotateTestAuth(session, consumed, "interleaved2")
+	if e, ok := err.(*utility.Error); !ok || e.No() != utility.Unauthorized {
+		t.Fatalf("storing the new pair of a revoked family = %v, want Unauthorized", err)
+	}
+	for _, key := range []string{tokenSet.AccessToken.Uuid, tokenSet.RefreshToken.Uuid, familyKey(session.FamilyId)} {
+		if testRedis.Exists(key) {
+			t.Errorf("%s is stored although the family is revoked", key)
+		}
+	}
+}
+
+func TestStoreAuthRotatedTwice(t *testing.T) {
+	session, consumed := storeTestAuth(t, "twice")
+
+	if _, err := consumeAuth(&consumed.RefreshToken, model.StoreTypeRefresh, model.RevokeReasonRotation); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotateTestAuth(session, consumed, "twice2"); err != nil {
+		t.Fatal(err)
+	}
+	// the family no longer points to the consumed pair
+	tokenSet, err := rotateTestAuth(session, consumed, "twice3")
+	if e, ok := err.(*utility.Error); !ok || e.No() != utility.Unauthorized {
+		t.Fatalf("replacing a pair twice = %v, want Unauthorized", err)
+	}
+	if testRedis.Exists(tokenSet.RefreshToken.Uuid) {
+		t.Errorf("the second replacement is stored")
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
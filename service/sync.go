@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/michibiki-io/ldap-jwt-go/model"
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+)
+
+const (
+	syncUsersKeyPrefix   = "syncusers:"
+	syncGroupKeyPrefix   = "syncgroup:"
+	syncPendingKeyPrefix = "syncpending:"
+	syncLockKeyPrefix    = "synclock:"
+	syncSinceKeyPrefix   = "syncsince:"
+)
+
+// Attributes of the changed groups with the DNs or the ids of the members
+var syncMemberAttributes = []string{"member", "uniqueMember", "memberUid"}
+
+// syncUsersKey is the hash of the lower case DN to the user id of the users
+// with sessions in the realm, which the synchroniser checks again.
+func syncUsersKey(realmName string) string {
+	return syncUsersKeyPrefix + realmName
+}
+
+// syncGroupKey is the set of the lower case DNs of the tracked users which
+// were members of the group when their tokens were issued.
+func syncGroupKey(realmName, groupDn string) string {
+	return syncGroupKeyPrefix + qualifiedUserId(realmName, strings.ToLower(groupDn))
+}
+
+// syncPendingKey is the set of the lower case DNs of the users to check again.
+func syncPendingKey(realmName string) string {
+	return syncPendingKeyPrefix + realmName
+}
+
+// LDAP_SYNC_INTERVAL
+// Seconds between polls of the changed users and groups (0: disabled)
+func (r *realm) syncInterval() time.Duration {
+	return time.Duration(r.intEnv("LDAP_SYNC_INTERVAL", 0)) * time.Second
+}
+
+// syncEnabled is false in the direct bind mode, which cannot search without
+// the credentials of a user.
+func (r *realm) syncEnabled() bool {
+	return r.syncInterval() > 0 && r.canSearch()
+}
+
+// LDAP_SYNC_ATTRIBUTE
+// Timestamp of the last change of an entry, whenChanged for AD
+func (r *realm) syncAttribute() string {
+	if r.isActiveDirectory() {
+		return r.env("LDAP_SYNC_ATTRIBUTE", "whenChanged")
+	}
+	return r.env("LDAP_SYNC_ATTRIBUTE", "modifyTimestamp")
+}
+
+// LDAP_SYNC_GROUP_FILTER
+// Filter of the group objects whose changes are tracked
+func (r *realm) syncGroupFilter() string {
+	if r.isActiveDirectory() {
+		return r.env("LDAP_SYNC_GROUP_FILTER", "(objectClass=group)")
+	}
+	return r.env("LDAP_SYNC_GROUP_FILTER", "(|(objectClass=groupOfNames)(objectClass=groupOfUniqueNames)(objectClass=posixGroup))")
+}
+
+// StartSync starts the synchroniser of every realm with LDAP_SYNC_INTERVAL.
+func StartSync() {
+	for _, r := range realms {
+		if r.syncEnabled() {
+			go r.syncLoop()
+		}
+	}
+}
+
+func (r *realm) syncLoop() {
+	interval := r.syncInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		// every instance polls, but only one of them checks each interval
+		if ok, err := redisClient.SetNX(syncLockKeyPrefix+r.name, now.Unix(), interval*9/10).Result(); err != nil || !ok {
+			continue
+		}
+
+		// the start of the last successful poll of any instance
+		since := now.Add(-interval)
+		if value, err := redisClient.Get(syncSinceKeyPrefix + r.name).Int64(); err == nil {
+			since = time.Unix(value, 0)
+		}
+		// the previous interval is searched again for the clock skew to LDAP
+		if err := r.syncChanges(context.Background(), since.Add(-interval)); err != nil {
+			utility.Log.Debug("Synchronising realm %s is failed: %v", r.name, err)
+			continue
+		}
+		redisClient.Set(syncSinceKeyPrefix+r.name, now.Unix(), 0)
+	}
+}
+
+// syncChanges queues the tracked users changed since, and the tracked
+// members of the changed groups before and after the change, then checks
+// a batch of the queued users.
+func (r *realm) syncChanges(ctx context.Context, since time.Time) error {
+	format := "20060102150405Z"
+	if r.isActiveDirectory() {
+		format = "20060102150405.0Z"
+	}
+	changed := "(" + r.syncAttribute() + ">=" + since.UTC().Format(format) + ")"
+
+	groups, err := r.search(ctx, r.groupBase, "(&"+r.syncGroupFilter()+changed+")", syncMemberAttributes...)
+	if err != nil {
+		return err
+	}
+	users, err := r.search(ctx, r.userBase, "(&"+r.userObjectFilter()+changed+")", "1.1")
+	if err != nil {
+		return err
+	}
+	tracked, err := redisClient.HGetAll(syncUsersKey(r.name)).Result()
+	if err != nil {
+		return err
+	}
+	trackedIds := map[string]string{}
+	for dn, userId := range tracked {
+		trackedIds[userId] = dn
+	}
+
+	pending := []interface{}{}
+	queue := func(dn string) {
+		if _, ok := tracked[strings.ToLower(dn)]; ok {
+			pending = append(pending, strings.ToLower(dn))
+		}
+	}
+	for _, entry := range users {
+		queue(entry.DN)
+	}
+	for _, group := range groups {
+		// the former members, who may have been removed
+		if previous, err := redisClient.SMembers(syncGroupKey(r.name, group.DN)).Result(); err == nil {
+			for _, dn := range previous {
+				queue(dn)
+			}
+		}
+		// the current members, who may have been added to a deny group
+		for _, attribute := range syncMemberAttributes {
+			for _, value := range group.GetAttributeValues(attribute) {
+				if dn, ok := trackedIds[value]; ok {
+					queue(dn)
+				} else {
+					queue(value)
+				}
+			}
+		}
+	}
+	if len(pending) > 0 {
+		if err := redisClient.SAdd(syncPendingKey(r.name), pending...).Err(); err != nil {
+			return err
+		}
+	}
+
+	return r.syncPending(ctx)
+}
+
+// syncPending checks up to LDAP_SYNC_BATCH queued users, the rest are
+// checked in the next intervals.
+func (r *realm) syncPending(ctx context.Context) error {
+	// LDAP_SYNC_BATCH
+	// Maximum users looked up again in an interval
+	dns, err := redisClient.SPopN(syncPendingKey(r.name), int64(r.intEnv("LDAP_SYNC_BATCH", 100))).Result()
+	if err != nil {
+		return err
+	}
+	for i, dn := range dns {
+		userId, err := redisClient.HGet(syncUsersKey(r.name), dn).Result()
+		if err != nil {
+			// not tracked any more
+			continue
+		}
+		if err := r.syncUser(ctx, dn, userId); utility.IsUnavailable(err) {
+			// LDAP is unavailable, check the rest later
+			for _, rest := range dns[i:] {
+				redisClient.SAdd(syncPendingKey(r.name), rest)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// syncUser looks the user up again, and revokes the sessions when the user
+// is not found, is disabled or is denied access. Other failures are returned.
+func (r *realm) syncUser(ctx context.Context, dn, userId string) error {
+	qualifiedId := r.qualify(userId)
+	if n, err := redisClient.Exists(userSessionsKey(qualifiedId)).Result(); err == nil && n == 0 {
+		// all sessions have expired
+		redisClient.HDel(syncUsersKey(r.name), dn)
+		return nil
+	}
+
+	invalidateUser(qualifiedId)
+	user, err := r.getUser(ctx, userId)
+	if err == nil {
+		err = r.checkAccess(ctx, &user)
+	}
+	if err == nil {
+		return nil
+	} else if e, ok := err.(*utility.Error); !ok || !(e.No() == utility.Unauthorized || utility.IsAccountError(err)) {
+		utility.Log.Debug("Synchronising user is failed, userId: %s, %v", qualifiedId, err)
+		return err
+	}
+
+	utility.Log.Audit("directory_change", "userId: %s, reason: %v", qualifiedId, err)
+	revokeUserSessions(qualifiedId, "", model.RevokeReasonDirectory)
+	r.invalidateOfflineCredentials(userId)
+	redisClient.HDel(syncUsersKey(r.name), dn)
+	return nil
+}
@@ -1,66 +1,25 @@
 package service
 
 import (
+	"context"
 	"crypto/rsa"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/michibiki-io/ldap-jwt-go/model"
 	"github.com/michibiki-io/ldap-jwt-go/utility"
 	"github.com/michibiki-io/ldap-jwt-go/utility/ldapc"
+	"github.com/twinj/uuid"
+	"gopkg.in/ldap.v2"
 )
 
-var ldapClient *ldapc.Client = nil
-
 var redisClient *redis.Client = nil
 
 func init() {
 
-	// LDAP_PROTOCOL
-	protocol := ldapc.LDAP
-	switch utility.GetEnv("LDAP_PROTOCOL", "LDAP") {
-	case "LDAPS":
-		protocol = ldapc.LDAPS
-	case "START_TLS":
-		protocol = ldapc.START_TLS
-	default:
-		protocol = ldapc.LDAP
-	}
-
-	// LDAP_HOST
-	ldapHost := utility.GetEnv("LDAP_HOST", "localhost")
-
-	// LDAP_PORT
-	ldapPort := utility.GetIntEnv("LDAP_PORT", 389)
-
-	// LDAP_SKIPVERIFY
-	// Skip verification of server certificate
-	skipVerify := utility.GetBoolEnv("LDAP_SKIPVERIFY", false)
-
-	// LDAP_BIND_DN
-	bindDn := utility.GetEnv("LDAP_BIND_DN", "cn=readonly,dc=example,dc=com")
-
-	// LDAP_BIND_PASSWORD
-	bindPassword := utility.GetEnv("LDAP_BIND_PASSWORD", "readonly")
-
-	// LDAP_BASE_DN
-	baseDn := utility.GetEnv("LDAP_BASE_DN", "dc=example,dc=com")
-
-	ldapClient = &ldapc.Client{
-		Protocol:  protocol,
-		Host:      ldapHost,
-		Port:      ldapPort,
-		TLSConfig: &tls.Config{InsecureSkipVerify: skipVerify},
-		Bind: ldapc.Bind{
-			BindDN:       bindDn,
-			BindPassword: bindPassword,
-			BaseDN:       baseDn,
-		},
-	}
-
 	//Initializing redis
 	dsn := utility.GetEnv("REDIS_HOST", "localhost:6379")
 	redisClient = redis.NewClient(&redis.Options{
@@ -72,7 +31,7 @@ func init() {
 	}
 }
 
-func verifyAuth(verifyKey *rsa.PublicKey, tokenString string, storeType model.StoreType) (
+func verifyAuth(ctx context.Context, verifyKey *rsa.PublicKey, tokenString string, storeType model.StoreType) (
 	token model.Token, expire_in int64, user model.User, storedAuth model.StoredAuth, error error) {
 
 	token = model.Token{}
@@ -95,7 +54,14 @@ func verifyAuth(verifyKey *rsa.PublicKey, tokenString string, storeType model.St
 		} else if storedAuth.Type != storeType {
 			error = utility.NewError(fmt.Sprintf("Token is invalid"), utility.Unauthorized)
 			utility.Log.Debug("Stored Token Type is different, UUID: %s", token.Uuid)
-		} else if user, error = getUser(storedAuth.UserId); error != nil {
+		} else if storedAuth.Realm != token.Realm {
+			error = utility.NewError(fmt.Sprintf("Token is invalid"), utility.Unauthorized)
+			utility.Log.Debug("Realm of the token is different, UUID: %s", token.Uuid)
+		} else if r := findRealm(storedAuth.Realm); r == nil {
+			error = utility.NewError(fmt.Sprintf("Realm is not found: %s", storedAuth.Realm), utility.Unauthorized)
+		} else if user, error = r.storedUser(ctx, &storedAuth, r.getCachedUser); error != nil {
+			return
+		} else if error = r.checkAccessOnVerify(ctx, &user); error != nil {
 			return
 		} else {
 			error = nil
@@ -105,14 +71,115 @@ func verifyAuth(verifyKey *rsa.PublicKey, tokenString string, storeType model.St
 
 }
 
-func getUser(userId string) (user model.User, error error) {
+// userAttributes returns the attributes read from the user entry.
+func (r *realm) userAttributes() []string {
+	attributes := []string{}
+	if r.isActiveDirectory() {
+		attributes = append(attributes, adUserAttributes...)
+	}
+	if attribute := r.idAttribute(); attribute != "" {
+		attributes = append(attributes, attribute)
+	}
+	attributes = append(attributes, r.accountAttributes()...)
+	for _, attribute := range r.claimAttributes() {
+		attributes = append(attributes, attribute)
+	}
+	attributes = append(attributes, r.groupValueAttributes()...)
+	if len(attributes) == 0 {
+		// no attributes, only the DN
+		attributes = append(attributes, "1.1")
+	}
+	return attributes
+}
+
+// LDAP_FILTER_USER
+// {username} is replaced by the user id
+// Without LDAP_FILTER_USER, LDAP_LOGIN_ATTRIBUTES are matched in the user objects.
+func (r *realm) userFilterTemplate() string {
+	if attributes := r.loginAttributes(); len(attributes) > 0 {
+		filter := ""
+		for _, attribute := range attributes {
+			filter += "(" + attribute + "={username})"
+		}
+		return r.env("LDAP_FILTER_USER", "(&"+r.userObjectFilter()+"(|"+filter+"))")
+	}
+	if r.isActiveDirectory() {
+		return r.env("LDAP_FILTER_USER", adDefaultFilterUser)
+	}
+	return r.env("LDAP_FILTER_USER", "(&(objectClass=posixAccount)(uid={username}))")
+}
+
+// LDAP_FILTER_USER_OBJECT
+// Filter of the user objects for LDAP_LOGIN_ATTRIBUTES and LDAP_ID_ATTRIBUTE
+func (r *realm) userObjectFilter() string {
+	if r.isActiveDirectory() {
+		return r.env("LDAP_FILTER_USER_OBJECT", adDefaultFilterObject)
+	}
+	return r.env("LDAP_FILTER_USER_OBJECT", "(objectClass=posixAccount)")
+}
+
+// LDAP_LOGIN_ATTRIBUTES
+// Comma separated attributes the username is matched with, e.g. uid,mail,employeeNumber
+func (r *realm) loginAttributes() []string {
+	attributes := []string{}
+	for _, attribute := range strings.Split(r.env("LDAP_LOGIN_ATTRIBUTES", ""), ",") {
+		if attribute = strings.TrimSpace(attribute); attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	return attributes
+}
+
+// LDAP_ID_ATTRIBUTE
+// Attribute of the user which becomes the user id, empty for the username
+// of the login (sAMAccountName for AD, uid with LDAP_LOGIN_ATTRIBUTES)
+func (r *realm) idAttribute() string {
+	if r.isActiveDirectory() {
+		return r.env("LDAP_ID_ATTRIBUTE", "sAMAccountName")
+	} else if len(r.loginAttributes()) > 0 {
+		return r.env("LDAP_ID_ATTRIBUTE", "uid")
+	}
+	return r.env("LDAP_ID_ATTRIBUTE", "")
+}
+
+// idRequired is true when the login may differ from the user id, so the id
+// is read from idAttribute instead of taking the username.
+func (r *realm) idRequired() bool {
+	return r.env("LDAP_ID_ATTRIBUTE", "") != "" || len(r.loginAttributes()) > 0
+}
+
+// idFilterTemplate finds the user by the user id on refresh and verify.
+// LDAP_FILTER_USER is used as before unless the id differs from the login.
+func (r *realm) idFilterTemplate() string {
+	if attribute := r.idAttribute(); attribute != "" && r.idRequired() {
+		return "(&" + r.userObjectFilter() + "(" + attribute + "={username}))"
+	}
+	return r.userFilter.String()
+}
+
+// getUser finds the user by the user id and checks the account status,
+// the caller is already authenticated by a token.
+func (r *realm) getUser(ctx context.Context, userId string) (user model.User, error error) {
+	if user, entry, err := r.searchUser(ctx, r.idFilter, userId); err != nil {
+		return user, err
+	} else {
+		return user, r.checkAccount(entry)
+	}
+}
+
+// loginUser finds the user by the username of the login. The account status
+// of the entry is checked after the password is verified, otherwise it would
+// be told to anyone who knows the username.
+func (r *realm) loginUser(ctx context.Context, username string) (user model.User, entry *ldap.Entry, error error) {
+	return r.searchUser(ctx, r.userFilter, username)
+}
+
+func (r *realm) searchUser(ctx context.Context, filter ldapc.Filter, userId string) (user model.User, entry *ldap.Entry, error error) {
 	user = model.User{}
+	entry = nil
 	error = nil
 
-	// LDAP_FILTER_USER
-	filter := utility.GetEnv("LDAP_FILTER_USER", "(&(objectClass=posixAccount)(uid=%s))")
-
-	if entries, err := ldapClient.Search(filter, userId); err != nil {
+	if entries, err := r.search(ctx, r.userBase, filter.Build(ldapc.Values{ldapc.PlaceholderUsername: userId}), r.userAttributes()...); err != nil {
 		error = err
 		return
 	} else if len(entries) < 1 {
@@ -123,39 +190,97 @@ func getUser(userId string) (user model.User, error error) {
 		utility.Log.Debug("Same UserId members are found: %v", err)
 		return
 	} else {
+		entry = entries[0]
 		user.DN = entries[0].DN
 		user.Id = userId
+		user.Realm = r.name
+
+		if attribute := r.idAttribute(); attribute != "" {
+			if id := entries[0].GetAttributeValue(attribute); id != "" {
+				user.Id = id
+			} else if r.idRequired() {
+				error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed: %s of the user is empty", attribute), utility.InternalServerError)
+				utility.Log.Debug("User id attribute is empty, DN: %s", user.DN)
+				return
+			}
+		}
+
+		for claim, attribute := range r.claimAttributes() {
+			if value := entries[0].GetAttributeValue(attribute); value != "" {
+				if user.Claims == nil {
+					user.Claims = map[string]string{}
+				}
+				user.Claims[claim] = value
+			}
+		}
 
-		// LDAP_FILTER_GROUP
-		filter := utility.GetEnv("LDAP_FILTER_GROUP", "(&(objectClass=groupOfNames)(member=%s))")
+		if r.isActiveDirectory() && r.adGroupsFromMemberOf() {
+			user.Groups = entries[0].GetAttributeValues("memberOf")
+		} else if user.Groups, error = r.userGroups(ctx, userId, entries[0]); error != nil {
+			return
+		}
 
-		if entries, error = ldapClient.Search(filter, user.DN); error == nil {
-			for _, group := range entries {
-				user.Groups = append(user.Groups, group.DN)
+		if r.nestedGroupsEnabled() {
+			if user.Groups, error = r.expandNestedGroups(ctx, user.Groups); error != nil {
+				return
 			}
 		}
 		return
 	}
 }
 
+// storedUser looks the user of storedAuth up again with lookup, or returns
+// the user captured at login when the realm cannot search without the password,
+// or when LDAP is unavailable and LDAP_OFFLINE_LOGIN is enabled.
+func (r *realm) storedUser(ctx context.Context, storedAuth *model.StoredAuth, lookup func(context.Context, string) (model.User, error)) (model.User, error) {
+	if r.canSearch() {
+		user, err := lookup(ctx, storedAuth.UserId)
+		if utility.IsUnavailable(err) && r.offlineLoginEnabled() && storedAuth.User != nil {
+			utility.Log.Debug("LDAP is unavailable, the user captured at login is used, userId: %s", r.qualify(storedAuth.UserId))
+			return *storedAuth.User, nil
+		}
+		return user, err
+	} else if storedAuth.User == nil {
+		return model.User{}, utility.NewError(fmt.Sprintf("User is not captured at login, userId: %s", storedAuth.UserId), utility.Unauthorized)
+	}
+	return *storedAuth.User, nil
+}
+
 type UserService struct{}
 
-func (s *UserService) Authorize(auth *model.Auth) (user model.User, error error) {
+func (s *UserService) Authorize(ctx context.Context, auth *model.Auth) (user model.User, policy model.PasswordPolicy, error error) {
 	user = model.User{}
+	policy = model.PasswordPolicy{ExpiresIn: -1, GraceLogins: -1}
 	error = nil
 
-	if ldapClient == nil {
-		error = utility.NewError(fmt.Sprintf("cannot access authentication server"), utility.InternalServerError)
-		utility.Log.Debug("LDAP client is not initialized, please check your LDAP server.")
+	// an empty password would be an unauthenticated bind, which many servers accept
+	if auth.Password == "" {
+		error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", auth.Username), utility.Unauthorized)
 		return
 	}
 
-	if tmpUser, err := getUser(auth.Username); error != nil {
+	if r, tmpUser, entry, err := lookupUser(ctx, auth.Username, auth.Password, auth.Realm); utility.IsUnavailable(err) {
+		user, error = offlineLogin(auth.Username, auth.Password, auth.Realm, err)
+	} else if err != nil {
+		error = err
+	} else if ldapPolicy, err := r.bindWithPolicy(ctx, tmpUser.DN, auth.Password); verifiedPolicyError(ldapPolicy, err) != nil {
+		error = verifiedPolicyError(ldapPolicy, err)
+	} else if utility.IsUnavailable(err) {
+		user, error = offlineLogin(auth.Username, auth.Password, auth.Realm, err)
+	} else if err != nil {
+		error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", auth.Username), utility.Unauthorized)
+	} else if err := r.checkAccount(entry); err != nil {
+		error = err
+	} else if err := r.checkAccess(ctx, &tmpUser); err != nil {
 		error = err
-	} else if error = ldapClient.DoBind(tmpUser.DN, auth.Password); error != nil {
-		error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", user.Id), utility.Unauthorized)
 	} else {
 		user = tmpUser
+		policy.ExpiresIn = ldapPolicy.ExpiresIn
+		policy.GraceLogins = ldapPolicy.Grace
+		cacheUser(&user)
+		if _, username, err := selectRealms(auth.Username, auth.Realm); err == nil {
+			r.storeOfflineCredential(r.loginName(username), auth.Password, &user)
+		}
 		error = nil
 	}
 
@@ -163,6 +288,15 @@ func (s *UserService) Authorize(auth *model.Auth) (user model.User, error error)
 }
 
 func (s *UserService) CreateAuth(user *model.User) (tokenSet model.TokenSet, expire_in model.ExpireIn, error error) {
+	session := model.Session{FamilyId: uuid.NewV4().String(), AuthTime: time.Now().Unix()}
+	if r := findRealm(user.Realm); r != nil && (r.directBind() || r.offlineLoginEnabled()) {
+		captured := *user
+		session.User = &captured
+	}
+	return createAuth(user, session, nil)
+}
+
+func createAuth(user *model.User, session model.Session, replaced *rotation) (tokenSet model.TokenSet, expire_in model.ExpireIn, error error) {
 
 	// return value
 	tokenSet = model.TokenSet{}
@@ -175,41 +309,26 @@ func (s *UserService) CreateAuth(user *model.User) (tokenSet model.TokenSet, exp
 		return
 	}
 
-	if ldapClient == nil {
-		error = utility.NewError(fmt.Sprintf("cannot access authentication server"), utility.InternalServerError)
-		utility.Log.Debug("LDAP client is not initialized, please check your LDAP server.")
-		return
-	}
-
 	expiration := utility.GetIntEnv("ACCESS_TOKEN_EXPIRE", 15)
-	if tokenSet.AccessToken, error = jwtService.CreateToken(accessTokenPair.SignKey, expiration); error != nil {
+	if tokenSet.AccessToken, error = jwtService.CreateToken(accessTokenPair.SignKey, expiration, user.Realm); error != nil {
 		tokenSet = model.TokenSet{}
 		return
 	}
 
 	expiration = utility.GetIntEnv("REFRESH_TOKEN_EXIPIRE", 60*24*7)
-	if tokenSet.RefreshToken, error = jwtService.CreateToken(refreshTokenPair.SignKey, expiration); error != nil {
+	if tokenSet.RefreshToken, error = jwtService.CreateToken(refreshTokenPair.SignKey, expiration, user.Realm); error != nil {
 		tokenSet = model.TokenSet{}
 		return
 	}
 
-	at := time.Unix(tokenSet.AccessToken.Expires, 0)
-	rt := time.Unix(tokenSet.RefreshToken.Expires, 0)
-	now := time.Now()
-
-	if jsonObj, err := json.Marshal(model.StoredAuth{UserId: user.Id, Type: model.StoreTypeAccess, LinkedUuid: tokenSet.RefreshToken.Uuid}); err != nil {
-		error = err
-		return
-	} else if error = redisClient.Set(tokenSet.AccessToken.Uuid, jsonObj, at.Sub(now)).Err(); error != nil {
+	if error = storeAuth(user, session, &tokenSet, replaced); error != nil {
+		tokenSet = model.TokenSet{}
 		return
 	}
 
-	if jsonObj, err := json.Marshal(model.StoredAuth{UserId: user.Id, Type: model.StoreTypeRefresh, LinkedUuid: tokenSet.AccessToken.Uuid}); err != nil {
-		error = err
-		return
-	} else if error = redisClient.Set(tokenSet.RefreshToken.Uuid, jsonObj, rt.Sub(now)).Err(); error != nil {
-		return
-	}
+	now := time.Now()
+	at := time.Unix(tokenSet.AccessToken.Expires, 0)
+	rt := time.Unix(tokenSet.RefreshToken.Expires, 0)
 
 	expire_in.AccessToken = int64(at.Sub(now).Seconds())
 	expire_in.RefreshToken = int64(rt.Sub(now).Seconds())
@@ -217,44 +336,95 @@ func (s *UserService) CreateAuth(user *model.User) (tokenSet model.TokenSet, exp
 
 }
 
-func (s *UserService) VerifyAuth(accessToken string) (user model.User, expire_in int64, error error) {
+func (s *UserService) VerifyAuth(ctx context.Context, accessToken string) (user model.User, expire_in int64, error error) {
 
 	user = model.User{}
 	error = nil
 
-	if _, expire_in, user, _, error = verifyAuth(accessTokenPair.VerifyKey, accessToken, model.StoreTypeAccess); error != nil {
+	if _, expire_in, user, _, error = verifyAuth(ctx, accessTokenPair.VerifyKey, accessToken, model.StoreTypeAccess); error != nil {
 		return
 	} else {
+		if r := findRealm(user.Realm); r != nil {
+			user.Groups = r.formatGroups(ctx, user.Groups)
+		}
 		error = nil
 		return
 	}
 }
 
-func (s *UserService) RefreshAuth(refreshToken string) (tokenSet model.TokenSet, expire_in int64, error error) {
+func (s *UserService) RefreshAuth(ctx context.Context, refreshToken string) (tokenSet model.TokenSet, expire_in int64, error error) {
 
 	tokenSet = model.TokenSet{}
 	error = nil
 	expire_in_ := model.ExpireIn{}
 
-	if stRefreshToken, _, userFromRedis, storedAuth, err := verifyAuth(refreshTokenPair.VerifyKey, refreshToken, model.StoreTypeRefresh); err != nil {
+	jwtService := JwtService{}
+
+	if stRefreshToken, _, err := jwtService.VerifyToken(refreshTokenPair.VerifyKey, refreshToken); err != nil {
+		error = err
+		return
+	} else if storedAuth, err := readAuth(&stRefreshToken, model.StoreTypeRefresh); err != nil {
+		if reused, reuseErr := detectReuse(&stRefreshToken); reused {
+			error = reuseErr
+			return
+		}
 		error = err
 		return
-	} else if deleted, err := redisClient.Del(stRefreshToken.Uuid).Result(); err != nil || deleted == 0 {
-		error = utility.NewError(err.Error(), utility.Unauthorized)
+	} else if err := checkSession(&storedAuth); err != nil {
+		// the session ends without the rotated mark, a replay is not a reuse
+		consumeAuth(&stRefreshToken, model.StoreTypeRefresh, model.RevokeReasonExpired)
+		error = err
 		return
-	} else if userFromLdap, err := getUser(userFromRedis.Id); err != nil {
-		error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", userFromRedis.Id), utility.Unauthorized)
+	} else if r := findRealm(storedAuth.Realm); r == nil {
+		error = utility.NewError(fmt.Sprintf("Realm is not found: %s", storedAuth.Realm), utility.Unauthorized)
 		return
-	} else if userFromRedis.DN != userFromLdap.DN {
-		error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", userFromRedis.Id), utility.Unauthorized)
+	} else if userFromLdap, err := r.storedUser(ctx, &storedAuth, r.getUser); err != nil {
+		// the token is not consumed yet, so the client can retry after 503
+		if utility.IsAccountError(err) || utility.IsUnavailable(err) {
+			error = err
+		} else {
+			error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", storedAuth.UserId), utility.Unauthorized)
+		}
 		return
-	} else if tokenSet, expire_in_, err = s.CreateAuth(&userFromLdap); err != nil {
-		error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", userFromRedis.Id), utility.InternalServerError)
-		utility.Log.Debug("CreateAuth is failed.")
+	} else if err := r.checkAccess(ctx, &userFromLdap); err != nil {
+		error = err
+		return
+	} else if storedAuth, err = consumeAuth(&stRefreshToken, model.StoreTypeRefresh, model.RevokeReasonRotation); err != nil {
+		// a concurrent refresh has consumed the token meanwhile
+		if reused, reuseErr := detectReuse(&stRefreshToken); reused {
+			error = reuseErr
+			return
+		}
+		error = err
 		return
 	} else {
-		if deleted, err = redisClient.Del(storedAuth.LinkedUuid).Result(); err != nil || deleted == 0 {
-			utility.Log.Debug("Deleting Linked Auth at Redis is failed, UUID: %s", storedAuth.LinkedUuid)
+		cacheUser(&userFromLdap)
+
+		session := storedAuth.Session
+		if session.User != nil {
+			captured := userFromLdap
+			session.User = &captured
+		}
+		// the new pair replaces the consumed one in the family
+		var replaced *rotation
+		if session.FamilyId == "" {
+			session.FamilyId = uuid.NewV4().String()
+		} else {
+			replaced = &rotation{accessUuid: storedAuth.LinkedUuid, refreshToken: &stRefreshToken}
+		}
+		if session.AuthTime == 0 {
+			session.AuthTime = time.Now().Unix()
+		}
+
+		if tokenSet, expire_in_, err = createAuth(&userFromLdap, session, replaced); err != nil {
+			if e, ok := err.(*utility.Error); ok && e.No() == utility.Unauthorized {
+				// the family is revoked during the refresh
+				error = err
+				return
+			}
+			error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", storedAuth.UserId), utility.InternalServerError)
+			utility.Log.Debug("CreateAuth is failed.")
+			return
 		}
 		expire_in = expire_in_.RefreshToken
 		error = nil
@@ -266,19 +436,82 @@ func (s *UserService) DeleteAuth(accessToken string) (error error) {
 
 	error = nil
 
-	if stAccessToken, _, _, storedAuth, err := verifyAuth(accessTokenPair.VerifyKey, accessToken, model.StoreTypeAccess); err != nil {
+	jwtService := JwtService{}
+
+	if stAccessToken, _, err := jwtService.VerifyToken(accessTokenPair.VerifyKey, accessToken); err != nil {
 		error = err
+	} else if storedAuth, err := consumeAuth(&stAccessToken, model.StoreTypeAccess, model.RevokeReasonLogout); err != nil {
+		error = err
+	} else {
+		invalidateUser(qualifiedUserId(storedAuth.Realm, storedAuth.UserId))
+	}
+	return
+}
+
+func (s *UserService) ChangePassword(ctx context.Context, passwordChange *model.PasswordChange) (error error) {
+
+	error = nil
+
+	if passwordChange.NewPassword == "" {
+		error = utility.NewError(fmt.Sprintf("New password is required"), utility.PasswordRejected)
+		return
+	} else if passwordChange.OldPassword == "" {
+		error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", passwordChange.Username), utility.Unauthorized)
 		return
+	}
+
+	var r *realm
+	user := model.User{}
+	var entry *ldap.Entry
+	familyId := ""
+	if passwordChange.AccessToken != "" {
+		if _, _, tokenUser, storedAuth, err := verifyAuth(ctx, accessTokenPair.VerifyKey, passwordChange.AccessToken, model.StoreTypeAccess); err != nil {
+			error = err
+			return
+		} else {
+			r = findRealm(storedAuth.Realm)
+			user = tokenUser
+			familyId = storedAuth.FamilyId
+		}
 	} else {
-		if deleted, err := redisClient.Del(stAccessToken.Uuid).Result(); err != nil || deleted == 0 {
-			utility.Log.Debug("Deleting Stored Auth at Redis is failed, UUID: %s", stAccessToken.Uuid)
+		// without a token, e.g. the password must be changed before login
+		if ldapRealm, ldapUser, ldapEntry, err := lookupUser(ctx, passwordChange.Username, passwordChange.OldPassword, passwordChange.Realm); utility.IsUnavailable(err) {
 			error = err
+			return
+		} else if err != nil {
+			error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", passwordChange.Username), utility.Unauthorized)
+			return
 		} else {
-			if deleted, err = redisClient.Del(storedAuth.LinkedUuid).Result(); err != nil || deleted == 0 {
-				utility.Log.Debug("Deleting Linked Auth at Redis is failed, UUID: %s", storedAuth.LinkedUuid)
-			}
-			error = nil
+			r = ldapRealm
+			user = ldapUser
+			entry = ldapEntry
 		}
-		return
 	}
+
+	if entry != nil && r.isActiveDirectory() && !r.directBind() {
+		// AD refuses the bind of an expired password, or of one which must be
+		// changed, so the change bound as the service account checks the old
+		// password. An inactive account is not told before that.
+		if err := r.checkAccountForPasswordChange(entry); err != nil {
+			error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", user.Id), utility.Unauthorized)
+		} else if error = r.ldapClient.ChangeADPasswordAsService(ctx, user.DN, passwordChange.OldPassword, passwordChange.NewPassword); error != nil {
+			utility.Log.Debug("Changing password is failed, userId: %s", user.Id)
+		}
+	} else if err := r.ldapClient.DoBind(ctx, user.DN, passwordChange.OldPassword); utility.IsUnavailable(err) {
+		error = err
+	} else if err != nil {
+		error = utility.NewError(fmt.Sprintf("LDAP Authenticate failed, userId: %s", user.Id), utility.Unauthorized)
+	} else if error = r.checkAccountForPasswordChange(entry); error != nil {
+		utility.Log.Debug("Changing password is rejected by the account status, userId: %s", user.Id)
+	} else if error = r.ldapClient.ChangePassword(ctx, user.DN, passwordChange.OldPassword, passwordChange.NewPassword, r.isActiveDirectory()); error != nil {
+		utility.Log.Debug("Changing password is failed, userId: %s", user.Id)
+	}
+
+	if error == nil {
+		utility.Log.Audit("password_changed", "userId: %s", r.qualify(user.Id))
+		revokeUserSessions(r.qualify(user.Id), familyId, model.RevokeReasonPassword)
+		invalidateUser(r.qualify(user.Id))
+		r.invalidateOfflineCredentials(user.Id)
+	}
+	return
 }
@@ -9,8 +9,36 @@ const (
 	UnexpectedSigningMethod                  // Unexpected signing method
 	UnprocessableEntity                      // UnprocessableEntity
 	InternalServerError                      // InternalServerError
+	AccountDisabled                          // account is disabled in the directory
+	AccountLocked                            // account is locked out
+	AccountExpired                           // account is expired
+	PasswordRejected                         // new password is rejected by the directory
+	PasswordExpired                          // password is expired
+	PasswordMustChange                       // password must be changed after reset
+	AccessDenied                             // user is not allowed to log in by the access rules
+	ServiceUnavailable                       // directory is unreachable or the circuit breaker is open
 )
 
+// IsUnavailable reports whether err tells the directory cannot be used now.
+func IsUnavailable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.No() == ServiceUnavailable
+	}
+	return false
+}
+
+// IsAccountError reports whether err tells the account cannot log in,
+// as opposed to wrong credentials.
+func IsAccountError(err error) bool {
+	if e, ok := err.(*Error); ok {
+		switch e.No() {
+		case AccountDisabled, AccountLocked, AccountExpired, PasswordExpired, PasswordMustChange, AccessDenied:
+			return true
+		}
+	}
+	return false
+}
+
 func NewError(errorText string, no ErrorCode) *Error {
 	return &Error{
 		text: errorText,
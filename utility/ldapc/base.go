@@ -0,0 +1,47 @@
+package ldapc
+
+import (
+	"fmt"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Scope of a search, the zero value searches the whole subtree.
+type Scope int
+
+const (
+	ScopeSubtree  Scope = iota // the base entry and all entries below it
+	ScopeOneLevel              // the entries just below the base entry
+	ScopeBase                  // only the base entry
+)
+
+var scopeNames = map[string]Scope{
+	"sub":  ScopeSubtree,
+	"one":  ScopeOneLevel,
+	"base": ScopeBase,
+}
+
+// ParseScope reads sub, one or base.
+func ParseScope(name string) (Scope, error) {
+	if scope, ok := scopeNames[name]; ok {
+		return scope, nil
+	}
+	return ScopeSubtree, fmt.Errorf("unsupported search scope: %s, use sub, one or base", name)
+}
+
+func (s Scope) ldapScope() int {
+	switch s {
+	case ScopeOneLevel:
+		return ldap.ScopeSingleLevel
+	case ScopeBase:
+		return ldap.ScopeBaseObject
+	default:
+		return ldap.ScopeWholeSubtree
+	}
+}
+
+// Base is where a search starts. An empty DN is Bind.BaseDN of the Client.
+type Base struct {
+	DN    string
+	Scope Scope
+}
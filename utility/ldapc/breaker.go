@@ -0,0 +1,67 @@
+package ldapc
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker fails fast after threshold consecutive failures until coolDown
+// has passed. Then requests are let through again, and the next failure
+// opens it at once while a success closes it.
+type breaker struct {
+	threshold int
+	coolDown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(threshold int, coolDown time.Duration) *breaker {
+	return &breaker{threshold: threshold, coolDown: coolDown}
+}
+
+// allow reports whether a request may be sent.
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *breaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures++; b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.coolDown)
+	}
+}
+
+// BreakerStatus is a snapshot of the circuit breaker.
+type BreakerStatus struct {
+	Open      bool  `json:"open"`
+	Failures  int   `json:"failures"`
+	OpenUntil int64 `json:"open_until,omitempty"`
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{Open: time.Now().Before(b.openUntil), Failures: b.failures}
+	if status.Open {
+		status.OpenUntil = b.openUntil.Unix()
+	}
+	return status
+}
@@ -0,0 +1,51 @@
+package ldapc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(3, 20*time.Millisecond)
+
+	b.failure()
+	b.failure()
+	if !b.allow() {
+		t.Fatal("the breaker opens before the threshold")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("the breaker is closed after the threshold")
+	}
+	if status := b.status(); !status.Open || status.Failures != 3 {
+		t.Errorf("status() = %+v, want open with 3 failures", status)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("the breaker is open after the cool down")
+	}
+	// the first failure after the cool down opens it at once
+	b.failure()
+	if b.allow() {
+		t.Fatal("the breaker is closed after a failure following the cool down")
+	}
+
+	b.success()
+	if !b.allow() {
+		t.Fatal("the breaker is open after a success")
+	}
+	if status := b.status(); status.Open || status.Failures != 0 {
+		t.Errorf("status() = %+v, want closed without failures", status)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Fatal("a disabled breaker opens")
+	}
+}
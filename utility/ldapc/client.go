@@ -3,8 +3,14 @@ package ldapc
 // Package ldapc provides easy LDAP v3 authentication.
 // Set LDAPC_DEBUG=yes to environment value then print debug log
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/michibiki-io/ldap-jwt-go/utility"
 	"gopkg.in/ldap.v2"
@@ -19,79 +25,378 @@ const (
 	START_TLS                 // TLS protocol
 )
 
-func searchFilter(filter, value string) string {
-	utility.Log.Debug("Search: filter: %v, key: %v\n", filter, value)
-	return fmt.Sprintf(filter, value)
-}
-
-func search(conn *ldap.Conn, baseDN string, filter string) ([]*ldap.Entry, error) {
-	utility.Log.Debug("Search: dn: %v, baseDN: %v, filter: %v\n", baseDN, filter)
-	request := ldap.NewSearchRequest(
-		baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
-		false, filter, nil, nil)
+func search(conn *ldap.Conn, request *ldap.SearchRequest, pageSize uint32) (*ldap.SearchResult, error) {
+	utility.Log.Debug("Search: baseDN: %v, filter: %v, attributes: %v\n", request.BaseDN, request.Filter, request.Attributes)
 
-	result, err := conn.Search(request)
+	var result *ldap.SearchResult
+	var err error
+	if pageSize > 0 {
+		result, err = conn.SearchWithPaging(request, pageSize)
+	} else {
+		result, err = conn.Search(request)
+	}
 	if err != nil {
-		return nil, utility.NewError(fmt.Sprintf("LDAP Search failed! (%v)", err), utility.InternalServerError)
+		return nil, err
 	}
 
-	return result.Entries, nil
+	return result, nil
 }
 
-func bind(conn *ldap.Conn, dn, password string) error {
-	err := conn.Bind(dn, password)
-	if err != nil {
-		return utility.NewError(fmt.Sprintf("LDAP Bind error, %s:%v", dn, err), utility.InternalServerError)
+// errCircuitOpen is returned while the circuit breaker fails fast.
+var errCircuitOpen = errors.New("LDAP circuit breaker is open")
+
+// emptyPasswordError is returned before binding with an empty password, which
+// is an unauthenticated bind (RFC 4513 5.1.2) that many servers accept.
+func emptyPasswordError(dn string) error {
+	return utility.NewError(fmt.Sprintf("LDAP Bind error, %s: empty password", dn), utility.Unauthorized)
+}
+
+// failureCode tells an unavailable directory apart from other failures.
+func failureCode(err error) utility.ErrorCode {
+	if _, ok := err.(*referralError); ok {
+		return utility.ServiceUnavailable
 	}
-	return nil
+	if err == errCircuitOpen || err == context.DeadlineExceeded || (err != context.Canceled && isConnError(err)) {
+		return utility.ServiceUnavailable
+	}
+	return utility.InternalServerError
 }
 
 // Client is a LDAP Client.
 // Protocol, Host, Prot, Bind are required parameter.
 // TLSConfig uses only Protocol is LDAP, LDAPS and START_TLS
+// When Servers is set, Protocol, Host and Port are ignored and a failed
+// server is skipped for CoolDown.
+// Connections are pooled when PoolSize is larger than 0.
 type Client struct {
-	Protocol  Protocol    // Security protocol. LDAP, LDAPS and START_TLS
-	Host      string      // LDAP Server host
-	Port      int         // Port number
-	TLSConfig *tls.Config // TLSConfig used only LDAPS or START_TLS
-	Bind      Bind        // Bind Information
+	Protocol    Protocol      // Security protocol. LDAP, LDAPS and START_TLS
+	Host        string        // LDAP Server host
+	Port        int           // Port number
+	Servers     []Server      // LDAP Servers for failover
+	Balance     Balance       // Priority or RoundRobin over Servers
+	CoolDown    time.Duration // How long a failed server is skipped
+	TLSConfig   *tls.Config   // TLSConfig used only LDAPS or START_TLS
+	Bind        Bind          // Bind Information
+	PoolSize    int           // Maximum connections of each pool, 0 disables pooling
+	IdleTimeout time.Duration // Idle pooled connections older than this are closed, 0 keeps them
+	PageSize    uint32        // Page size of the simple paged results control, 0 disables paging
+	SizeLimit   int           // Maximum entries of a search, 0 is no limit
+	TimeLimit   int           // Maximum seconds of a search, 0 is no limit
+
+	DialTimeout      time.Duration // Timeout of connecting to a server, 0 is no limit
+	Timeout          time.Duration // Timeout of an operation including failover, 0 is no limit
+	BreakerThreshold int           // Consecutive failures which open the circuit breaker, 0 disables it
+	BreakerCoolDown  time.Duration // How long the open circuit breaker fails fast
+	Referrals        Referrals     // Following search result references to other servers
+
+	breakerOnce sync.Once
+	breaker     *breaker
+
+	serversOnce sync.Once
+	servers     *serverList
+
+	poolOnce   sync.Once
+	searchPool *pool // connections bound as Bind.BindDN
+	bindPool   *pool // connections for user credential binds
 }
 
-func (c *Client) DoBind(dn, password string) error {
-	conn, err := c.dial()
-	if err != nil {
-		return err
+// conn is a LDAP connection with the server it is connected to.
+type conn struct {
+	*ldap.Conn
+	server *serverState
+}
+
+func (c *Client) serverList() *serverList {
+	c.serversOnce.Do(func() {
+		servers := c.Servers
+		if len(servers) == 0 {
+			servers = []Server{{Protocol: c.Protocol, Host: c.Host, Port: c.Port}}
+		}
+		c.servers = newServerList(servers, c.Balance, c.CoolDown)
+	})
+	return c.servers
+}
+
+func (c *Client) circuitBreaker() *breaker {
+	c.breakerOnce.Do(func() {
+		c.breaker = newBreaker(c.BreakerThreshold, c.BreakerCoolDown)
+	})
+	return c.breaker
+}
+
+// BreakerStatus returns the state of the circuit breaker.
+func (c *Client) BreakerStatus() BreakerStatus {
+	return c.circuitBreaker().status()
+}
+
+func (c *Client) pools() (searchPool, bindPool *pool) {
+	if c.PoolSize <= 0 {
+		return nil, nil
+	}
+	c.poolOnce.Do(func() {
+		c.searchPool = newPool(c.PoolSize, c.IdleTimeout, c.dial, c.serviceBind, c.serverList().preferred)
+		c.bindPool = newPool(c.PoolSize, c.IdleTimeout, c.dial, nil, c.serverList().preferred)
+	})
+	return c.searchPool, c.bindPool
+}
+
+// Stats returns metrics of the search and the bind pools.
+func (c *Client) Stats() (search, bind PoolStats) {
+	if searchPool, bindPool := c.pools(); searchPool != nil {
+		return searchPool.Stats(), bindPool.Stats()
+	}
+	return PoolStats{}, PoolStats{}
+}
+
+// ServerStatus returns the health of every server.
+func (c *Client) ServerStatus() []ServerStatus {
+	return c.serverList().status()
+}
+
+func (c *Client) serviceBind(conn *ldap.Conn) error {
+	return conn.Bind(c.Bind.BindDN, c.Bind.BindPassword)
+}
+
+// withConn runs op on a pooled or a new connection. While the connection
+// turns out to be broken, the server is marked down and op is retried on
+// the next server. op is aborted when ctx is done or Timeout has passed.
+func (c *Client) withConn(ctx context.Context, p *pool, prepare func(*ldap.Conn) error, op func(*ldap.Conn) error) (err error) {
+	if !c.circuitBreaker().allow() {
+		return errCircuitOpen
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	defer func() {
+		c.record(err)
+	}()
+
+	for attempt := 0; attempt < len(c.serverList().states); attempt++ {
+		var cn *conn
+		if p != nil {
+			cn, err = p.get(ctx)
+		} else if cn, err = c.dial(ctx); err == nil && prepare != nil {
+			if err = runOp(ctx, cn, prepare); err != nil {
+				cn.Close()
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		err = runOp(ctx, cn, op)
+		if p != nil {
+			p.put(cn, err)
+		} else {
+			cn.Close()
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if !isConnError(err) {
+			return err
+		}
+		utility.Log.Debug("LDAP Auth : %v failed: %v\n", cn.server.server, err)
+		c.serverList().markDown(cn.server)
+	}
+	return err
+}
+
+// record counts the failures of the directory for the circuit breaker,
+// a request canceled by the client is not a failure.
+func (c *Client) record(err error) {
+	switch {
+	case err == context.Canceled:
+	case err == context.DeadlineExceeded || isConnError(err):
+		c.circuitBreaker().failure()
+	default:
+		c.circuitBreaker().success()
+	}
+}
+
+// runOp runs op and closes the connection when ctx is done, which aborts op.
+func runOp(ctx context.Context, cn *conn, op func(*ldap.Conn) error) error {
+	if ctx.Done() == nil {
+		return op(cn.Conn)
 	}
-	defer conn.Close()
 
-	return bind(conn, dn, password)
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cn.Close()
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+
+	err := op(cn.Conn)
+	close(done)
+	if <-aborted {
+		return ctx.Err()
+	}
+	return err
 }
 
-func (c *Client) Search(filter, value string) ([]*ldap.Entry, error) {
-	conn, err := c.dial()
+func (c *Client) DoBind(ctx context.Context, dn, password string) error {
+	if password == "" {
+		return emptyPasswordError(dn)
+	}
+	_, bindPool := c.pools()
+
+	err := c.withConn(ctx, bindPool, nil, func(conn *ldap.Conn) error {
+		return conn.Bind(dn, password)
+	})
 	if err != nil {
-		return nil, err
+		return utility.NewError(fmt.Sprintf("LDAP Bind error, %s:%v", dn, err), failureCode(err))
 	}
-	defer conn.Close()
+	return nil
+}
 
-	bind(conn, c.Bind.BindDN, c.Bind.BindPassword)
+func (c *Client) searchRequest(base Base, filter string, attributes []string) *ldap.SearchRequest {
+	if len(attributes) == 0 {
+		attributes = nil
+	}
+	if base.DN == "" {
+		base.DN = c.Bind.BaseDN
+	}
+	return ldap.NewSearchRequest(
+		base.DN, base.Scope.ldapScope(), ldap.NeverDerefAliases, c.SizeLimit, c.TimeLimit,
+		false, filter, attributes, nil)
+}
 
-	return search(conn, c.Bind.BaseDN, searchFilter(filter, value))
+// Search returns the entries in base which match filter, see Filter.Build.
+// Only the given attributes are returned, all user attributes when none is given.
+// The referrals of the result are followed when Referrals.Follow is set.
+func (c *Client) Search(ctx context.Context, base Base, filter string, attributes ...string) ([]*ldap.Entry, error) {
+	searchPool, _ := c.pools()
+
+	request := c.searchRequest(base, filter, attributes)
+
+	var result *ldap.SearchResult
+	err := c.withConn(ctx, searchPool, c.serviceBind, func(conn *ldap.Conn) (err error) {
+		// SearchWithPaging adds its control to the request
+		request.Controls = nil
+		result, err = search(conn, request, c.PageSize)
+		return
+	})
+	if err == nil {
+		var referred []*ldap.Entry
+		if referred, err = c.followReferrals(ctx, request, result.Referrals, c.serviceBind); err == nil {
+			return append(result.Entries, referred...), nil
+		}
+	}
+	return nil, utility.NewError(fmt.Sprintf("LDAP Search failed! (%v)", err), failureCode(err))
 }
 
-func (c *Client) dial() (*ldap.Conn, error) {
-	if c.Protocol == LDAPS {
-		utility.Log.Debug("LDAP Auth : Start LDAPS Protocol\n")
-		return ldap.DialTLS("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port), c.TLSConfig)
+// SearchAs is Search bound as dn instead of Bind.BindDN, for directories
+// without a service account. Wrong credentials return Unauthorized.
+func (c *Client) SearchAs(ctx context.Context, dn, password string, base Base, filter string, attributes ...string) ([]*ldap.Entry, error) {
+	entries, _, err := c.SearchAsWithPolicy(ctx, dn, password, base, filter, attributes...)
+	return entries, err
+}
+
+// SearchAsWithPolicy is SearchAs which binds with the password policy request
+// control. The policy is returned even when the bind or the search fails, e.g.
+// a password which must be changed after a reset may not search.
+func (c *Client) SearchAsWithPolicy(ctx context.Context, dn, password string, base Base, filter string, attributes ...string) ([]*ldap.Entry, PasswordPolicy, error) {
+	policy := PasswordPolicy{ExpiresIn: -1, Grace: -1, Error: -1}
+	if password == "" {
+		return nil, policy, emptyPasswordError(dn)
 	}
+	_, bindPool := c.pools()
+
+	request := c.searchRequest(base, filter, attributes)
 
-	conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port))
+	bind := func(conn *ldap.Conn) error {
+		return conn.Bind(dn, password)
+	}
+
+	var result *ldap.SearchResult
+	err := c.withConn(ctx, bindPool, nil, func(conn *ldap.Conn) (err error) {
+		if policy, err = bindWithPolicy(conn, dn, password); err != nil {
+			return
+		}
+		request.Controls = nil
+		result, err = search(conn, request, c.PageSize)
+		return
+	})
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, policy, utility.NewError(fmt.Sprintf("LDAP Bind error, %s:%v", dn, err), utility.Unauthorized)
+	} else if err == nil {
+		var referred []*ldap.Entry
+		if referred, err = c.followReferrals(ctx, request, result.Referrals, bind); err == nil {
+			return append(result.Entries, referred...), policy, nil
+		}
+	}
+	return nil, policy, utility.NewError(fmt.Sprintf("LDAP Search failed! (%v)", err), failureCode(err))
+}
+
+// dial connects to the first available server.
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	err := fmt.Errorf("Dial: no LDAP server")
+	for _, state := range c.serverList().candidates() {
+		var lc *ldap.Conn
+		if lc, err = c.dialServer(ctx, state.server); err == nil {
+			c.serverList().markUp(state)
+			return &conn{Conn: lc, server: state}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		utility.Log.Debug("LDAP Auth : %v is unavailable: %v\n", state.server, err)
+		c.serverList().markDown(state)
+	}
+	return nil, err
+}
+
+func (c *Client) dialServer(ctx context.Context, server Server) (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{}
+	if c.TLSConfig != nil {
+		tlsConfig = c.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = server.Host
+	}
+
+	addr := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+
+	dialer := &net.Dialer{Timeout: c.DialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("Dial: %v", err)
 	}
 
-	if c.Protocol == START_TLS {
-		if err = conn.StartTLS(c.TLSConfig); err != nil {
+	if server.Protocol == LDAPS {
+		utility.Log.Debug("LDAP Auth : Start LDAPS Protocol\n")
+		tlsConn := tls.Client(netConn, tlsConfig)
+		if c.DialTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(c.DialTimeout))
+		}
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("Dial: %v", err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn := ldap.NewConn(tlsConn, true)
+		conn.Start()
+		conn.SetTimeout(c.Timeout)
+		return conn, nil
+	}
+
+	conn := ldap.NewConn(netConn, false)
+	conn.Start()
+	conn.SetTimeout(c.Timeout)
+
+	if server.Protocol == START_TLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
 			utility.Log.Debug("LDAP Auth : Start TLS Protocol\n")
 			conn.Close()
 			return nil, fmt.Errorf("StartTLS: %v", err)
@@ -0,0 +1,36 @@
+package ldapc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EscapeDN escapes value to be used as an attribute value of a DN (RFC 4514).
+func EscapeDN(value string) string {
+	escaped := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch {
+		case ch == ',' || ch == '+' || ch == '"' || ch == '\\' || ch == '<' || ch == '>' || ch == ';' || ch == '=':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(ch)
+		case ch == 0:
+			escaped.WriteString("\\00")
+		case i == 0 && (ch == ' ' || ch == '#'):
+			escaped.WriteByte('\\')
+			escaped.WriteByte(ch)
+		case i == len(value)-1 && ch == ' ':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(ch)
+		default:
+			escaped.WriteByte(ch)
+		}
+	}
+	return escaped.String()
+}
+
+// BindDN builds the bind DN of a user from template, %s is replaced by
+// the escaped username, e.g. uid=%s,ou=people,dc=example,dc=com or %s@example.com
+func BindDN(template, username string) string {
+	return fmt.Sprintf(template, EscapeDN(username))
+}
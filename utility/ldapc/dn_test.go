@@ -0,0 +1,47 @@
+package ldapc
+
+import "testing"
+
+func TestEscapeDN(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"alice", "alice"},
+		{"", ""},
+		{"Smith, John", `Smith\, John`},
+		{"a+b", `a\+b`},
+		{`"quoted"`, `\"quoted\"`},
+		{`back\slash`, `back\\slash`},
+		{"<a>;b=c", `\<a\>\;b\=c`},
+		{"nul\x00byte", `nul\00byte`},
+		{" leading", `\ leading`},
+		{"trailing ", `trailing\ `},
+		{"in side", "in side"},
+		{"#hash", `\#hash`},
+		{"has#hash", "has#hash"},
+		{"alice,ou=admins", `alice\,ou\=admins`},
+	}
+	for _, test := range tests {
+		if got := EscapeDN(test.value); got != test.want {
+			t.Errorf("EscapeDN(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestBindDN(t *testing.T) {
+	tests := []struct {
+		template string
+		username string
+		want     string
+	}{
+		{"uid=%s,ou=people,dc=example,dc=com", "alice", "uid=alice,ou=people,dc=example,dc=com"},
+		{"uid=%s,ou=people,dc=example,dc=com", "alice,ou=admins", `uid=alice\,ou\=admins,ou=people,dc=example,dc=com`},
+		{"%s@example.com", "alice", "alice@example.com"},
+	}
+	for _, test := range tests {
+		if got := BindDN(test.template, test.username); got != test.want {
+			t.Errorf("BindDN(%q, %q) = %q, want %q", test.template, test.username, got, test.want)
+		}
+	}
+}
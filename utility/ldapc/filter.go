@@ -0,0 +1,95 @@
+package ldapc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Placeholders of filter templates.
+const (
+	PlaceholderUsername  = "username"  // the username of the login
+	PlaceholderDN        = "dn"        // DN of the user, or of the group for nested groups
+	PlaceholderMember    = "member"    // the value which identifies the user as a member of a group
+	PlaceholderUid       = "uid"       // uid of the user
+	PlaceholderUidNumber = "uidNumber" // uidNumber of the user
+	PlaceholderGidNumber = "gidNumber" // gidNumber of the user, the primary group
+)
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+	legacyPattern      = regexp.MustCompile(`%(\[1\])?s`)
+)
+
+// Values are the values of the placeholders of a Filter.
+type Values map[string]string
+
+// Filter is a search filter template with named placeholders,
+// e.g. (&(objectClass=posixAccount)(uid={username})).
+// The values are escaped by RFC 4515 when the filter is built.
+type Filter struct {
+	template string
+	names    map[string]bool
+}
+
+// ParseFilter validates template. Only the allowed placeholders can be
+// used, and %s or %[1]s of former templates is read as legacy.
+func ParseFilter(template string, legacy string, allowed ...string) (Filter, error) {
+	if legacy != "" {
+		template = legacyPattern.ReplaceAllString(template, "{"+legacy+"}")
+	}
+
+	filter := Filter{template: template, names: map[string]bool{}}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(template, -1) {
+		known := false
+		for _, name := range allowed {
+			known = known || name == match[1]
+		}
+		if !known {
+			return Filter{}, fmt.Errorf("unknown placeholder {%s} in filter %s, use one of %v", match[1], template, allowed)
+		}
+		filter.names[match[1]] = true
+	}
+
+	sample := Values{}
+	for name := range filter.names {
+		sample[name] = "x"
+	}
+	if _, err := ldap.CompileFilter(filter.Build(sample)); err != nil {
+		return Filter{}, fmt.Errorf("invalid filter %s: %v", template, err)
+	}
+	return filter, nil
+}
+
+// Build replaces the placeholders with the escaped values,
+// a placeholder without a value is replaced with an empty string.
+func (f Filter) Build(values Values) string {
+	return placeholderPattern.ReplaceAllStringFunc(f.template, func(placeholder string) string {
+		return EscapeFilter(values[placeholder[1:len(placeholder)-1]])
+	})
+}
+
+// Uses reports whether the placeholder appears in the filter.
+func (f Filter) Uses(name string) bool {
+	return f.names[name]
+}
+
+func (f Filter) String() string {
+	return f.template
+}
+
+// EscapeFilter escapes value to be used as an assertion value of a filter (RFC 4515).
+func EscapeFilter(value string) string {
+	escaped := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		switch ch := value[i]; ch {
+		case '*', '(', ')', '\\', 0:
+			escaped.WriteString(fmt.Sprintf("\\%02x", ch))
+		default:
+			escaped.WriteByte(ch)
+		}
+	}
+	return escaped.String()
+}
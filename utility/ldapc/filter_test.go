@@ -0,0 +1,78 @@
+package ldapc
+
+import "testing"
+
+func TestEscapeFilter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"alice", "alice"},
+		{"", ""},
+		{"*", `\2a`},
+		{"a*)(uid=*", `a\2a\29\28uid=\2a`},
+		{`back\slash`, `back\5cslash`},
+		{"nul\x00byte", `nul\00byte`},
+		{"*)(|(objectClass=*)", `\2a\29\28|\28objectClass=\2a\29`},
+		{"名前", "名前"},
+	}
+	for _, test := range tests {
+		if got := EscapeFilter(test.value); got != test.want {
+			t.Errorf("EscapeFilter(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestFilterBuild(t *testing.T) {
+	tests := []struct {
+		template string
+		legacy   string
+		values   Values
+		want     string
+	}{
+		{"(uid={username})", "", Values{PlaceholderUsername: "alice"}, "(uid=alice)"},
+		{"(uid={username})", "", Values{PlaceholderUsername: "*"}, `(uid=\2a)`},
+		{"(uid={username})", "", Values{PlaceholderUsername: "x)(uid=*"}, `(uid=x\29\28uid=\2a)`},
+		{"(uid={username})", "", Values{}, "(uid=)"},
+		{"(member={dn})", "", Values{PlaceholderDN: `cn=a\,b,dc=example,dc=com`}, `(member=cn=a\5c,b,dc=example,dc=com)`},
+		{"(|(uid={username})(mail={username}))", "", Values{PlaceholderUsername: "a*"}, `(|(uid=a\2a)(mail=a\2a))`},
+		{"(uid=%s)", PlaceholderUsername, Values{PlaceholderUsername: "a("}, `(uid=a\28)`},
+		{"(uid=%[1]s)", PlaceholderUsername, Values{PlaceholderUsername: "a)"}, `(uid=a\29)`},
+	}
+	for _, test := range tests {
+		filter, err := ParseFilter(test.template, test.legacy, PlaceholderUsername, PlaceholderDN)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", test.template, err)
+			continue
+		}
+		if got := filter.Build(test.values); got != test.want {
+			t.Errorf("%s.Build(%v) = %q, want %q", test.template, test.values, got, test.want)
+		}
+	}
+}
+
+func TestParseFilterInvalid(t *testing.T) {
+	tests := []string{
+		"(uid={uidNumber})",
+		"(uid={unknown})",
+		"(uid={username}",
+		"uid={username})(",
+	}
+	for _, template := range tests {
+		if _, err := ParseFilter(template, "", PlaceholderUsername); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded, want an error", template)
+		}
+	}
+}
+
+func TestFilterUses(t *testing.T) {
+	filter, err := ParseFilter("(&(memberUid={uid})(gidNumber={gidNumber}))", "", PlaceholderUid, PlaceholderGidNumber, PlaceholderDN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{PlaceholderUid: true, PlaceholderGidNumber: true, PlaceholderDN: false} {
+		if got := filter.Uses(name); got != want {
+			t.Errorf("Uses(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
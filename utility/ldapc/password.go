@@ -0,0 +1,137 @@
+package ldapc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"gopkg.in/ldap.v2"
+)
+
+// Password policy errors of draft-behera-ldap-password-policy
+const (
+	PolicyPasswordExpired  int8 = 0
+	PolicyAccountLocked    int8 = 1
+	PolicyChangeAfterReset int8 = 2
+)
+
+// PasswordPolicy is the password policy response control of a user bind.
+// Each field is -1 when the server did not return it.
+type PasswordPolicy struct {
+	ExpiresIn int64 // Seconds before the password expires
+	Grace     int64 // Remaining logins with the expired password
+	Error     int8  // Password policy error, see Policy... constants
+}
+
+// DoBindWithPolicy binds as dn with the password policy request control.
+// The policy is returned even when the bind fails.
+func (c *Client) DoBindWithPolicy(ctx context.Context, dn, password string) (PasswordPolicy, error) {
+	policy := PasswordPolicy{ExpiresIn: -1, Grace: -1, Error: -1}
+	if password == "" {
+		return policy, emptyPasswordError(dn)
+	}
+	_, bindPool := c.pools()
+
+	err := c.withConn(ctx, bindPool, nil, func(conn *ldap.Conn) (err error) {
+		policy, err = bindWithPolicy(conn, dn, password)
+		return
+	})
+	if err != nil {
+		return policy, utility.NewError(fmt.Sprintf("LDAP Bind error, %s:%v", dn, err), failureCode(err))
+	}
+	return policy, nil
+}
+
+// bindWithPolicy binds conn as dn with the password policy request control.
+func bindWithPolicy(conn *ldap.Conn, dn, password string) (PasswordPolicy, error) {
+	policy := PasswordPolicy{ExpiresIn: -1, Grace: -1, Error: -1}
+	request := ldap.NewSimpleBindRequest(dn, password, []ldap.Control{ldap.NewControlBeheraPasswordPolicy()})
+	result, err := conn.SimpleBind(request)
+	if result != nil {
+		if control, ok := ldap.FindControl(result.Controls, ldap.ControlTypeBeheraPasswordPolicy).(*ldap.ControlBeheraPasswordPolicy); ok {
+			policy = PasswordPolicy{ExpiresIn: control.Expire, Grace: control.Grace, Error: control.Error}
+		}
+	}
+	return policy, err
+}
+
+// ChangePassword binds as dn with oldPassword and changes its password.
+// The Password Modify extended operation (RFC 3062) is used, except for
+// Active Directory which requires unicodePwd to be modified instead.
+func (c *Client) ChangePassword(ctx context.Context, dn, oldPassword, newPassword string, activeDirectory bool) error {
+	if oldPassword == "" {
+		return emptyPasswordError(dn)
+	}
+	_, bindPool := c.pools()
+
+	err := c.withConn(ctx, bindPool, nil, func(conn *ldap.Conn) error {
+		if err := conn.Bind(dn, oldPassword); err != nil {
+			return err
+		}
+
+		if activeDirectory {
+			return conn.Modify(adPasswordChange(dn, oldPassword, newPassword))
+		}
+
+		// empty userIdentity changes the password of the bound user
+		_, err := conn.PasswordModify(ldap.NewPasswordModifyRequest("", oldPassword, newPassword))
+		return err
+	})
+	if isConnError(err) {
+		return utility.NewError(fmt.Sprintf("LDAP Password change error, %s:%v", dn, err), failureCode(err))
+	} else if err != nil {
+		return utility.NewError(fmt.Sprintf("LDAP Password change error, %s:%v", dn, err), utility.PasswordRejected)
+	}
+	return nil
+}
+
+// ChangeADPasswordAsService changes the password of dn on Active Directory
+// bound as Bind.BindDN. AD checks oldPassword when the old value is deleted,
+// so the password can be changed when dn cannot bind, e.g. the password is
+// expired or must be changed at the next logon. A wrong oldPassword returns
+// Unauthorized.
+func (c *Client) ChangeADPasswordAsService(ctx context.Context, dn, oldPassword, newPassword string) error {
+	if oldPassword == "" {
+		return emptyPasswordError(dn)
+	}
+	searchPool, _ := c.pools()
+
+	err := c.withConn(ctx, searchPool, c.serviceBind, func(conn *ldap.Conn) error {
+		return conn.Modify(adPasswordChange(dn, oldPassword, newPassword))
+	})
+	if err == nil {
+		return nil
+	} else if failureCode(err) == utility.ServiceUnavailable {
+		return utility.NewError(fmt.Sprintf("LDAP Password change error, %s:%v", dn, err), utility.ServiceUnavailable)
+	} else if isADWrongPassword(err) {
+		return utility.NewError(fmt.Sprintf("LDAP Password change error, %s:%v", dn, err), utility.Unauthorized)
+	}
+	return utility.NewError(fmt.Sprintf("LDAP Password change error, %s:%v", dn, err), utility.PasswordRejected)
+}
+
+// adPasswordChange deletes the old value of unicodePwd and adds the new one,
+// which is a password change by the user rather than a reset.
+func adPasswordChange(dn, oldPassword, newPassword string) *ldap.ModifyRequest {
+	request := ldap.NewModifyRequest(dn)
+	request.Delete("unicodePwd", []string{encodeUnicodePwd(oldPassword)})
+	request.Add("unicodePwd", []string{encodeUnicodePwd(newPassword)})
+	return request
+}
+
+// isADWrongPassword reports whether AD rejected the old value of unicodePwd,
+// ERROR_INVALID_PASSWORD (0x56). A new password which breaks the password
+// policy is ERROR_PASSWORD_RESTRICTION (0x52D) instead.
+func isADWrongPassword(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation) && strings.Contains(err.Error(), "00000056")
+}
+
+// encodeUnicodePwd returns the quoted UTF-16LE password AD expects.
+func encodeUnicodePwd(password string) string {
+	encoded := []byte{}
+	for _, r := range utf16.Encode([]rune("\"" + password + "\"")) {
+		encoded = append(encoded, byte(r), byte(r>>8))
+	}
+	return string(encoded)
+}
@@ -0,0 +1,32 @@
+package ldapc
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/ldap.v2"
+)
+
+func TestEncodeUnicodePwd(t *testing.T) {
+	if got, want := encodeUnicodePwd("pw"), "\"\x00p\x00w\x00\"\x00"; got != want {
+		t.Errorf("encodeUnicodePwd(pw) = %q, want %q", got, want)
+	}
+}
+
+func TestIsADWrongPassword(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("00000056: AtrErr: DSID-03190F80, #1:\n\t0: 00000056: DSID-03190F80, problem 1005 (CONSTRAINT_ATT_TYPE), data 0, Att 9005a (unicodePwd)")), true},
+		{ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("0000052D: Constraint violation - check_password_restrictions: the password is too short")), false},
+		{ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("00000056: insufficient access")), false},
+		{errors.New("00000056"), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := isADWrongPassword(test.err); got != test.want {
+			t.Errorf("isADWrongPassword(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
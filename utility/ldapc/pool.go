@@ -0,0 +1,190 @@
+package ldapc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Idle connections older than this are checked before being reused.
+const livenessCheckAfter = 10 * time.Second
+
+// PoolStats is a snapshot of pool metrics.
+type PoolStats struct {
+	Size   int    `json:"size"`   // Maximum number of connections
+	Open   int    `json:"open"`   // Connections currently open (in use and idle)
+	Idle   int    `json:"idle"`   // Connections waiting for reuse
+	Dials  uint64 `json:"dials"`  // New connections
+	Reused uint64 `json:"reused"` // Idle connections handed out again
+	Closed uint64 `json:"closed"` // Connections closed by the pool
+	Dead   uint64 `json:"dead"`   // Idle connections that failed the liveness check
+	Waits  uint64 `json:"waits"`  // Requests that waited for a free connection
+}
+
+type idleConn struct {
+	conn  *conn
+	since time.Time
+}
+
+// pool keeps a bounded number of LDAP connections for reuse.
+type pool struct {
+	size        int
+	idleTimeout time.Duration
+	dial        func(ctx context.Context) (*conn, error)
+	prepare     func(*ldap.Conn) error // called once for every new connection
+	preferred   func() *serverState    // idle connections to other servers are closed, nil keeps them
+
+	slots chan struct{}
+
+	mu    sync.Mutex
+	idle  []idleConn
+	stats PoolStats
+}
+
+func newPool(size int, idleTimeout time.Duration, dial func(ctx context.Context) (*conn, error), prepare func(*ldap.Conn) error, preferred func() *serverState) *pool {
+	return &pool{
+		size:        size,
+		idleTimeout: idleTimeout,
+		dial:        dial,
+		prepare:     prepare,
+		preferred:   preferred,
+		slots:       make(chan struct{}, size),
+		stats:       PoolStats{Size: size},
+	}
+}
+
+// get returns an idle connection or dials a new one.
+// Every connection from get must be returned by put.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.mu.Lock()
+		p.stats.Waits++
+		p.mu.Unlock()
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// after a failover, the connections to the backup server are dropped
+	// once the preferred server is healthy again
+	var preferred *serverState
+	if p.preferred != nil {
+		preferred = p.preferred()
+	}
+
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		idle := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		idleFor := time.Since(idle.since)
+		if p.idleTimeout > 0 && idleFor > p.idleTimeout {
+			p.close(idle.conn)
+			continue
+		}
+		if preferred != nil && idle.conn.server != preferred {
+			p.close(idle.conn)
+			continue
+		}
+		if idleFor > livenessCheckAfter && !alive(idle.conn.Conn) {
+			p.mu.Lock()
+			p.stats.Dead++
+			p.mu.Unlock()
+			p.close(idle.conn)
+			continue
+		}
+
+		p.mu.Lock()
+		p.stats.Reused++
+		p.mu.Unlock()
+		return idle.conn, nil
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	if p.prepare != nil {
+		if err := runOp(ctx, conn, p.prepare); err != nil {
+			conn.Close()
+			<-p.slots
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	p.stats.Dials++
+	p.stats.Open++
+	p.mu.Unlock()
+	return conn, nil
+}
+
+// put gives the connection back to the pool.
+// err is the result of the last operation; broken connections are closed.
+func (p *pool) put(conn *conn, err error) {
+	defer func() { <-p.slots }()
+
+	if isConnError(err) {
+		p.close(conn)
+		return
+	}
+
+	p.mu.Lock()
+	p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+	p.mu.Unlock()
+}
+
+func (p *pool) close(conn *conn) {
+	conn.Close()
+	p.mu.Lock()
+	p.stats.Open--
+	p.stats.Closed++
+	p.mu.Unlock()
+}
+
+// Stats returns a snapshot of the pool metrics.
+func (p *pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Idle = len(p.idle)
+	return stats
+}
+
+// alive reads the root DSE to make sure the server still answers.
+func alive(conn *ldap.Conn) bool {
+	request := ldap.NewSearchRequest(
+		"", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0,
+		false, "(objectClass=*)", []string{"1.1"}, nil)
+	_, err := conn.Search(request)
+	return !isConnError(err)
+}
+
+// isConnError reports whether the connection can no longer be used after err.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(*ldap.Error); ok {
+		switch e.ResultCode {
+		case ldap.ErrorNetwork, ldap.ErrorUnexpectedMessage, ldap.ErrorUnexpectedResponse,
+			ldap.LDAPResultBusy, ldap.LDAPResultUnavailable, ldap.LDAPResultProtocolError:
+			return true
+		}
+		return false
+	}
+	return true
+}
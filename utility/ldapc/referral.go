@@ -0,0 +1,182 @@
+package ldapc
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/michibiki-io/ldap-jwt-go/utility"
+	"gopkg.in/ldap.v2"
+)
+
+// Referrals: how search result references are followed
+type Referrals struct {
+	Follow       bool     // Follow the references, they are dropped when false
+	HopLimit     int      // Maximum referrals followed one after another
+	TrustedHosts []string // Hosts referrals may point to, *.example.com matches subdomains
+}
+
+// referralError is a failed search of a trusted referral. The result would
+// miss the entries of the referred server, so the search fails as unavailable.
+type referralError struct {
+	url string
+	err error
+}
+
+func (e *referralError) Error() string {
+	return fmt.Sprintf("referral %s failed: %v", e.url, e.err)
+}
+
+// referral is a parsed ldap:// or ldaps:// search result reference.
+type referral struct {
+	url    string
+	server Server
+	base   Base
+}
+
+// parseReferral parses ldap://host[:port]/dn[??scope]. The DN and the scope
+// default to the ones of the request which returned the reference.
+func parseReferral(rawURL string, startTLS bool, request *ldap.SearchRequest) (referral, error) {
+	server, err := ParseURL(rawURL, startTLS)
+	if err != nil {
+		return referral{}, err
+	}
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return referral{}, err
+	}
+
+	ref := referral{url: rawURL, server: server, base: Base{DN: request.BaseDN}}
+	switch request.Scope {
+	case ldap.ScopeBaseObject:
+		ref.base.Scope = ScopeBase
+	case ldap.ScopeSingleLevel:
+		ref.base.Scope = ScopeOneLevel
+	}
+
+	if dn := strings.TrimPrefix(u.Path, "/"); dn != "" {
+		ref.base.DN = dn
+	}
+	// attributes?scope?filter
+	if parts := strings.Split(u.RawQuery, "?"); len(parts) > 1 && parts[1] != "" {
+		if ref.base.Scope, err = ParseScope(parts[1]); err != nil {
+			return referral{}, err
+		}
+	}
+	return ref, nil
+}
+
+// trustedHost returns whether a referral may point to host. The configured
+// servers are always trusted.
+func (c *Client) trustedHost(host string) bool {
+	for _, state := range c.serverList().states {
+		if strings.EqualFold(state.server.Host, host) {
+			return true
+		}
+	}
+	for _, trusted := range c.Referrals.TrustedHosts {
+		if strings.HasPrefix(trusted, "*.") {
+			if len(host) > len(trusted)-1 && strings.EqualFold(host[len(host)-len(trusted)+1:], trusted[1:]) {
+				return true
+			}
+		} else if strings.EqualFold(trusted, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// secure returns whether a configured server uses TLS. Then ldap://
+// referrals use START_TLS, so the credentials are never sent in clear text.
+func (c *Client) secure() bool {
+	for _, state := range c.serverList().states {
+		if state.server.Protocol != LDAP {
+			return true
+		}
+	}
+	return false
+}
+
+// followReferrals searches the referred servers bound by bind, and returns
+// the entries found there. Malformed and untrusted referrals are skipped,
+// a trusted referral which cannot be searched fails with referralError.
+func (c *Client) followReferrals(ctx context.Context, request *ldap.SearchRequest, urls []string, bind func(*ldap.Conn) error) ([]*ldap.Entry, error) {
+	if !c.Referrals.Follow || len(urls) == 0 {
+		return nil, nil
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	return c.followReferralHops(ctx, request, urls, bind, map[string]bool{}, 1)
+}
+
+func (c *Client) followReferralHops(ctx context.Context, request *ldap.SearchRequest, urls []string, bind func(*ldap.Conn) error, visited map[string]bool, hop int) ([]*ldap.Entry, error) {
+	entries := []*ldap.Entry{}
+	if hop > c.Referrals.HopLimit {
+		utility.Log.Debug("LDAP Referral : hop limit %d is reached, %v are not followed\n", c.Referrals.HopLimit, urls)
+		return entries, nil
+	}
+
+	for _, rawURL := range urls {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if visited[rawURL] {
+			continue
+		}
+		visited[rawURL] = true
+
+		ref, err := parseReferral(rawURL, c.secure(), request)
+		if err != nil {
+			utility.Log.Debug("LDAP Referral : %s is invalid: %v\n", rawURL, err)
+			continue
+		}
+		if !c.trustedHost(ref.server.Host) {
+			utility.Log.Debug("LDAP Referral : %s is not a trusted host\n", rawURL)
+			continue
+		}
+
+		result, err := c.searchReferral(ctx, ref, request, bind)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, &referralError{url: rawURL, err: err}
+		}
+		entries = append(entries, result.Entries...)
+
+		referred, err := c.followReferralHops(ctx, request, result.Referrals, bind, visited, hop+1)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, referred...)
+	}
+	return entries, nil
+}
+
+// searchReferral runs request on a new connection to the referred server.
+func (c *Client) searchReferral(ctx context.Context, ref referral, request *ldap.SearchRequest, bind func(*ldap.Conn) error) (*ldap.SearchResult, error) {
+	lc, err := c.dialServer(ctx, ref.server)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: lc}
+	defer cn.Close()
+
+	referred := *request
+	referred.BaseDN = ref.base.DN
+	referred.Scope = ref.base.Scope.ldapScope()
+	referred.Controls = nil
+
+	var result *ldap.SearchResult
+	err = runOp(ctx, cn, func(conn *ldap.Conn) (err error) {
+		if err = bind(conn); err != nil {
+			return
+		}
+		result, err = search(conn, &referred, c.PageSize)
+		return
+	})
+	return result, err
+}
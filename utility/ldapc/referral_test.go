@@ -0,0 +1,83 @@
+package ldapc
+
+import (
+	"testing"
+
+	"gopkg.in/ldap.v2"
+)
+
+func TestTrustedHost(t *testing.T) {
+	c := &Client{
+		Protocol:  LDAPS,
+		Host:      "ldap.example.com",
+		Port:      636,
+		Referrals: Referrals{Follow: true, HopLimit: 3, TrustedHosts: []string{"*.example.org", "dc1.example.net"}},
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"ldap.example.com", true},
+		{"LDAP.Example.COM", true},
+		{"other.example.com", false},
+		{"a.example.org", true},
+		{"a.b.example.org", true},
+		{"A.EXAMPLE.ORG", true},
+		{"example.org", false},
+		{".example.org", false},
+		{"evilexample.org", false},
+		{"a.example.org.evil.com", false},
+		{"dc1.example.net", true},
+		{"dc2.example.net", false},
+		{"sub.dc1.example.net", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := c.trustedHost(test.host); got != test.want {
+			t.Errorf("trustedHost(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
+
+func TestTrustedHostServers(t *testing.T) {
+	c := &Client{Servers: []Server{{Protocol: LDAP, Host: "dc1.example.com", Port: 389}, {Protocol: LDAP, Host: "dc2.example.com", Port: 389}}}
+	for host, want := range map[string]bool{"dc1.example.com": true, "dc2.example.com": true, "dc3.example.com": false} {
+		if got := c.trustedHost(host); got != want {
+			t.Errorf("trustedHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if c.secure() {
+		t.Errorf("secure() = true for ldap:// servers")
+	}
+}
+
+func TestParseReferral(t *testing.T) {
+	request := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=alice)", nil, nil)
+	tests := []struct {
+		url      string
+		startTLS bool
+		server   Server
+		base     Base
+	}{
+		{"ldap://dc1.example.com/", false, Server{LDAP, "dc1.example.com", 389}, Base{DN: "dc=example,dc=com", Scope: ScopeSubtree}},
+		{"ldap://dc1.example.com/ou=people,dc=example,dc=com", true, Server{START_TLS, "dc1.example.com", 389}, Base{DN: "ou=people,dc=example,dc=com", Scope: ScopeSubtree}},
+		{"ldaps://dc1.example.com:3269/dc=example,dc=com??one", false, Server{LDAPS, "dc1.example.com", 3269}, Base{DN: "dc=example,dc=com", Scope: ScopeOneLevel}},
+		{"ldap://dc1.example.com/dc=example,dc=com??base?(objectClass=*)", false, Server{LDAP, "dc1.example.com", 389}, Base{DN: "dc=example,dc=com", Scope: ScopeBase}},
+	}
+	for _, test := range tests {
+		ref, err := parseReferral(test.url, test.startTLS, request)
+		if err != nil {
+			t.Errorf("parseReferral(%q) failed: %v", test.url, err)
+			continue
+		}
+		if ref.server != test.server || ref.base != test.base {
+			t.Errorf("parseReferral(%q) = %v %v, want %v %v", test.url, ref.server, ref.base, test.server, test.base)
+		}
+	}
+
+	for _, url := range []string{"http://dc1.example.com/", "ldap:///dc=example,dc=com", "ldap://dc1.example.com/dc=example,dc=com??all"} {
+		if _, err := parseReferral(url, false, request); err == nil {
+			t.Errorf("parseReferral(%q) succeeded, want an error", url)
+		}
+	}
+}
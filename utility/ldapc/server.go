@@ -0,0 +1,167 @@
+package ldapc
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balance: how a server is chosen from Client.Servers
+type Balance int
+
+const (
+	Priority   Balance = iota // Always prefer the first healthy server
+	RoundRobin                // Rotate over the healthy servers
+)
+
+// Server is one LDAP server of the Client.
+type Server struct {
+	Protocol Protocol // Security protocol. LDAP, LDAPS and START_TLS
+	Host     string   // LDAP Server host
+	Port     int      // Port number
+}
+
+func (s Server) String() string {
+	scheme := "ldap"
+	if s.Protocol == LDAPS {
+		scheme = "ldaps"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(s.Host, strconv.Itoa(s.Port)))
+}
+
+// ParseURL parses ldap://host[:port] and ldaps://host[:port].
+// ldap:// servers use START_TLS when startTLS is true.
+func ParseURL(rawURL string, startTLS bool) (Server, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return Server{}, err
+	}
+
+	server := Server{Host: u.Hostname()}
+	switch strings.ToLower(u.Scheme) {
+	case "ldap":
+		server.Protocol, server.Port = LDAP, 389
+		if startTLS {
+			server.Protocol = START_TLS
+		}
+	case "ldaps":
+		server.Protocol, server.Port = LDAPS, 636
+	default:
+		return Server{}, fmt.Errorf("unsupported LDAP URL scheme: %s", rawURL)
+	}
+	if server.Host == "" {
+		return Server{}, fmt.Errorf("LDAP URL has no host: %s", rawURL)
+	}
+	if port := u.Port(); port != "" {
+		if server.Port, err = strconv.Atoi(port); err != nil {
+			return Server{}, fmt.Errorf("invalid LDAP URL port: %s", rawURL)
+		}
+	}
+	return server, nil
+}
+
+// ServerStatus is a snapshot of the health of a server.
+type ServerStatus struct {
+	URL       string `json:"url"`
+	Up        bool   `json:"up"`
+	Failures  uint64 `json:"failures"`
+	DownUntil int64  `json:"down_until,omitempty"`
+}
+
+type serverState struct {
+	server    Server
+	failures  uint64
+	downUntil time.Time
+}
+
+// serverList tracks the health of the servers of a Client.
+type serverList struct {
+	balance  Balance
+	coolDown time.Duration
+	next     uint32
+
+	mu     sync.Mutex
+	states []*serverState
+}
+
+func newServerList(servers []Server, balance Balance, coolDown time.Duration) *serverList {
+	list := &serverList{balance: balance, coolDown: coolDown}
+	for _, server := range servers {
+		list.states = append(list.states, &serverState{server: server})
+	}
+	return list
+}
+
+// candidates returns the servers in the order they should be tried.
+// Servers in cool-down are only returned when no server is healthy.
+func (l *serverList) candidates() []*serverState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	healthy, down := []*serverState{}, []*serverState{}
+	for _, state := range l.states {
+		if now.Before(state.downUntil) {
+			down = append(down, state)
+		} else {
+			healthy = append(healthy, state)
+		}
+	}
+	if len(healthy) == 0 {
+		return down
+	}
+
+	if l.balance == RoundRobin {
+		start := int(atomic.AddUint32(&l.next, 1)-1) % len(healthy)
+		rotated := make([]*serverState, 0, len(healthy))
+		rotated = append(rotated, healthy[start:]...)
+		healthy = append(rotated, healthy[:start]...)
+	}
+	return healthy
+}
+
+// preferred returns the first healthy server with Priority, which pooled
+// connections to other servers give way to. It is nil with RoundRobin.
+func (l *serverList) preferred() *serverState {
+	if l.balance != Priority {
+		return nil
+	}
+	if candidates := l.candidates(); len(candidates) > 0 {
+		return candidates[0]
+	}
+	return nil
+}
+
+func (l *serverList) markDown(state *serverState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state.failures++
+	state.downUntil = time.Now().Add(l.coolDown)
+}
+
+func (l *serverList) markUp(state *serverState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state.downUntil = time.Time{}
+}
+
+func (l *serverList) status() []ServerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	result := []ServerStatus{}
+	for _, state := range l.states {
+		status := ServerStatus{URL: state.server.String(), Up: !now.Before(state.downUntil), Failures: state.failures}
+		if !status.Up {
+			status.DownUntil = state.downUntil.Unix()
+		}
+		result = append(result, status)
+	}
+	return result
+}
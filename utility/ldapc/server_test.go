@@ -0,0 +1,80 @@
+package ldapc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		startTLS bool
+		want     Server
+	}{
+		{"ldap://dc1.example.com", false, Server{LDAP, "dc1.example.com", 389}},
+		{"ldap://dc1.example.com", true, Server{START_TLS, "dc1.example.com", 389}},
+		{" LDAP://dc1.example.com:1389 ", false, Server{LDAP, "dc1.example.com", 1389}},
+		{"ldaps://dc1.example.com", true, Server{LDAPS, "dc1.example.com", 636}},
+		{"ldaps://[2001:db8::1]:3269", false, Server{LDAPS, "2001:db8::1", 3269}},
+	}
+	for _, test := range tests {
+		if got, err := ParseURL(test.url, test.startTLS); err != nil {
+			t.Errorf("ParseURL(%q) failed: %v", test.url, err)
+		} else if got != test.want {
+			t.Errorf("ParseURL(%q) = %+v, want %+v", test.url, got, test.want)
+		}
+	}
+
+	for _, url := range []string{"http://dc1.example.com", "dc1.example.com", "ldap://", "ldap://dc1.example.com:port"} {
+		if _, err := ParseURL(url, false); err == nil {
+			t.Errorf("ParseURL(%q) succeeded, want an error", url)
+		}
+	}
+}
+
+func hosts(states []*serverState) []string {
+	result := []string{}
+	for _, state := range states {
+		result = append(result, state.server.Host)
+	}
+	return result
+}
+
+func TestServerListPriority(t *testing.T) {
+	list := newServerList([]Server{{Host: "a"}, {Host: "b"}, {Host: "c"}}, Priority, time.Minute)
+
+	if got := hosts(list.candidates()); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("candidates() = %v, want [a b c]", got)
+	}
+	list.markDown(list.states[0])
+	if got := hosts(list.candidates()); len(got) != 2 || got[0] != "b" {
+		t.Errorf("candidates() = %v after a is down, want [b c]", got)
+	}
+	if preferred := list.preferred(); preferred == nil || preferred.server.Host != "b" {
+		t.Errorf("preferred() is not b after a is down")
+	}
+	list.markUp(list.states[0])
+	if preferred := list.preferred(); preferred == nil || preferred.server.Host != "a" {
+		t.Errorf("preferred() is not a after a is up again")
+	}
+
+	// every server is down, they are still tried
+	for _, state := range list.states {
+		list.markDown(state)
+	}
+	if got := list.candidates(); len(got) != 3 {
+		t.Errorf("candidates() = %v when every server is down, want all of them", hosts(got))
+	}
+}
+
+func TestServerListRoundRobin(t *testing.T) {
+	list := newServerList([]Server{{Host: "a"}, {Host: "b"}}, RoundRobin, time.Minute)
+
+	first, second := list.candidates()[0].server.Host, list.candidates()[0].server.Host
+	if first == second {
+		t.Errorf("candidates() starts with %s twice, want rotation", first)
+	}
+	if list.preferred() != nil {
+		t.Errorf("preferred() is not nil with RoundRobin")
+	}
+}
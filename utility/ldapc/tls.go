@@ -0,0 +1,83 @@
+package ldapc
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+// TLSOptions describes how to build the TLSConfig of a Client.
+type TLSOptions struct {
+	SkipVerify bool     // Skip verification of server certificate
+	CAFile     string   // PEM file of CA certificates to trust instead of the system pool
+	ServerName string   // Host name to verify instead of the host of the server
+	MinVersion string   // Minimum TLS version: 1.0, 1.1, 1.2 or 1.3
+	CertFile   string   // PEM file of the client certificate for mutual TLS
+	KeyFile    string   // PEM file of the client private key for mutual TLS
+	Pins       []string // base64 SHA-256 of the SubjectPublicKeyInfo of an accepted certificate
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig builds a tls.Config for LDAPS and START_TLS.
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: options.SkipVerify,
+		ServerName:         options.ServerName,
+	}
+
+	if options.MinVersion != "" {
+		if version, ok := tlsVersions[options.MinVersion]; !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %s", options.MinVersion)
+		} else {
+			config.MinVersion = version
+		}
+	}
+
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate is found in %s", options.CAFile)
+		}
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(options.Pins) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range options.Pins {
+			pins[pin] = true
+		}
+		// VerifyConnection is called even when InsecureSkipVerify is true,
+		// so a pin alone can be used to trust a self-signed certificate.
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return fmt.Errorf("certificate of %s does not match the pinned public keys", state.ServerName)
+		}
+	}
+
+	return config, nil
+}
@@ -16,6 +16,11 @@ func (l *Logger) Debug(format string, args ...interface{}) {
 	}
 }
 
+// Audit prints security relevant events regardless of the log level.
+func (l *Logger) Audit(event string, format string, args ...interface{}) {
+	log.Printf("[AUDIT] "+event+": "+format, args...)
+}
+
 func GetEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value